@@ -0,0 +1,258 @@
+package robotally
+
+import (
+	"crypto/hmac"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/google/go-github/github"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/log"
+	"google.golang.org/appengine/taskqueue"
+)
+
+// outcome describes what processing a webhook event did, reported as JSON to
+// admins requesting it for integration testing.
+type outcome struct {
+	Action    string `json:"action"`               // Action taken (e.g. created, updated, skipped)
+	Up        int    `json:"up"`                   // Number of binding upvotes tallied
+	Down      int    `json:"down"`                 // Number of binding downvotes tallied
+	CommentID int    `json:"comment_id,omitempty"` // Identifier of the report comment touched
+}
+
+// recorder is a response writer tracking whether an error status was sent.
+type recorder struct {
+	http.ResponseWriter
+	failed bool
+}
+
+// WriteHeader records whether the status code is an error before sending it.
+func (r *recorder) WriteHeader(code int) {
+	r.failed = code >= http.StatusBadRequest
+	r.ResponseWriter.WriteHeader(code)
+}
+
+// authorized checks whether an admin request carries the configured secret.
+func authorized(r *http.Request) bool {
+	if adminSecret == "" {
+		return false
+	}
+	return hmac.Equal([]byte(r.Header.Get("X-Admin-Secret")), []byte(adminSecret))
+}
+
+// reprocessHandler rebuilds the status reports of all the open pull requests
+// of a repository with the current aggregation logic and configuration. Each
+// pull request is refreshed in its own queued task, so large repositories don't
+// run into the request deadline.
+func reprocessHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := appengine.NewContext(r)
+
+	if r.Method != "POST" {
+		http.Error(w, "Unsupported method", http.StatusMethodNotAllowed)
+		return
+	}
+	if !authorized(r) {
+		http.Error(w, "Unauthorized request", http.StatusUnauthorized)
+		return
+	}
+	owner, repo := r.FormValue("owner"), r.FormValue("repo")
+	if owner == "" || repo == "" {
+		http.Error(w, "Missing owner or repo", http.StatusBadRequest)
+		return
+	}
+	// Iterate over all the open pull requests and queue a refresh for each of them
+	client := newClient(ctx)
+
+	var pending []refreshTask
+	opt := &github.PullRequestListOptions{State: "open", ListOptions: github.ListOptions{PerPage: 100}}
+	for {
+		prs, res, err := client.PullRequests.List(owner, repo, opt)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Failed to list pull requests: %v", err), errorStatus(err))
+			return
+		}
+		for _, pr := range prs {
+			pending = append(pending, refreshTask{Owner: owner, Repo: repo, Number: *pr.Number})
+		}
+		if res.NextPage == 0 {
+			break
+		}
+		opt.Page = res.NextPage
+	}
+	if err := queueRefreshes(ctx, pending); err != nil {
+		http.Error(w, fmt.Sprintf("Failed to queue report refreshes: %v", err), errorStatus(err))
+		return
+	}
+	fmt.Fprintf(w, "Queued %d pull requests\n", len(pending))
+}
+
+// refreshTask identifies a pull request whose report is to be refreshed in the
+// background, forcing an edit even if the tally did not change if requested.
+type refreshTask struct {
+	Owner  string
+	Repo   string
+	Number int
+	Force  bool
+}
+
+// maxTaskBatch is the number of tasks the task queue accepts in a single call.
+const maxTaskBatch = 100
+
+// enqueue adds a batch of tasks to the default push queue, replaceable to run
+// the endpoints scheduling them without a task queue.
+var enqueue = func(ctx context.Context, tasks []*taskqueue.Task) error {
+	_, err := taskqueue.AddMulti(ctx, tasks, "")
+	return err
+}
+
+// queueRefreshes schedules a report refresh task for each of the given pull
+// requests, in batches the task queue can handle.
+func queueRefreshes(ctx context.Context, pending []refreshTask) error {
+	tasks := make([]*taskqueue.Task, 0, len(pending))
+	for _, task := range pending {
+		tasks = append(tasks, taskqueue.NewPOSTTask("/tasks/refresh", url.Values{
+			"owner":  {task.Owner},
+			"repo":   {task.Repo},
+			"number": {strconv.Itoa(task.Number)},
+			"force":  {strconv.FormatBool(task.Force)},
+		}))
+	}
+	for start := 0; start < len(tasks); start += maxTaskBatch {
+		end := start + maxTaskBatch
+		if end > len(tasks) {
+			end = len(tasks)
+		}
+		if err := enqueue(ctx, tasks[start:end]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// refreshTaskHandler refreshes the status report of a single pull request, as
+// queued by the admin and cron endpoints. Permanent failures are only logged,
+// as the task queue would otherwise retry them forever.
+func refreshTaskHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := appengine.NewContext(r)
+
+	// AppEngine strips this header from external requests, so only the task queue can set it
+	if r.Header.Get("X-Appengine-Queuename") == "" {
+		http.Error(w, "Unauthorized request", http.StatusUnauthorized)
+		return
+	}
+	owner, repo := r.FormValue("owner"), r.FormValue("repo")
+	number, err := strconv.Atoi(r.FormValue("number"))
+	if owner == "" || repo == "" || err != nil {
+		log.Errorf(ctx, "Dropping malformed refresh task: %v", r.Form)
+		return
+	}
+	if _, err := refresh(ctx, newClient(ctx), owner, repo, number, false, r.FormValue("force") == "true"); err != nil {
+		if status := errorStatus(err); status < http.StatusInternalServerError {
+			log.Errorf(ctx, "Failed to refresh %s/%s#%d report: %v", owner, repo, number, err)
+			return
+		}
+		http.Error(w, fmt.Sprintf("Failed to refresh report: %v", err), errorStatus(err))
+	}
+}
+
+// selftestHandler checks that the configured GitHub token works, reporting the
+// user it authenticates as, its OAuth scopes and the access it has to each of
+// the repositories requested via repo=owner/name parameters.
+func selftestHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := appengine.NewContext(r)
+
+	if r.Method != "GET" {
+		http.Error(w, "Unsupported method", http.StatusMethodNotAllowed)
+		return
+	}
+	if !authorized(r) {
+		http.Error(w, "Unauthorized request", http.StatusUnauthorized)
+		return
+	}
+	// Make sure the token authenticates and belongs to the configured user
+	client := newClient(ctx)
+
+	user, res, err := client.Users.Get("")
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to authenticate with GitHub token: %v", err), http.StatusBadGateway)
+		return
+	}
+	fmt.Fprintf(w, "Authenticated as %s\n", login(user))
+	if login(user) != githubUser {
+		fmt.Fprintf(w, "Warning: configured user is %s\n", githubUser)
+	}
+	fmt.Fprintf(w, "Token scopes: %s\n", res.Header.Get("X-OAuth-Scopes"))
+
+	// Check the access to each of the requested repositories
+	for _, name := range r.URL.Query()["repo"] {
+		parts := strings.SplitN(name, "/", 2)
+		if len(parts) != 2 {
+			fmt.Fprintf(w, "%s: invalid repository, expected owner/name\n", name)
+			continue
+		}
+		repo, _, err := client.Repositories.Get(parts[0], parts[1])
+		if err != nil {
+			fmt.Fprintf(w, "%s: inaccessible: %v\n", name, err)
+			continue
+		}
+		granted := []string{}
+		if repo.Permissions != nil {
+			for perm, ok := range *repo.Permissions {
+				if ok {
+					granted = append(granted, perm)
+				}
+			}
+		}
+		sort.Strings(granted)
+		fmt.Fprintf(w, "%s: accessible, permissions: %s\n", name, strings.Join(granted, " "))
+	}
+}
+
+// cronHandler queues a re-render of the status reports of all the tracked pull
+// requests that weren't updated for longer than the stale age, refreshing their
+// timestamps and applying the current configuration. Reports that are closed,
+// opted out of or not on GitHub are left alone.
+func cronHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := appengine.NewContext(r)
+
+	// AppEngine strips this header from external requests, so only cron can set it
+	if r.Header.Get("X-Appengine-Cron") != "true" {
+		http.Error(w, "Unauthorized request", http.StatusUnauthorized)
+		return
+	}
+	if staleReports == 0 {
+		fmt.Fprintf(w, "Stale report refreshing disabled\n")
+		return
+	}
+	keys, records, err := staleRecords(ctx, now().Add(-staleReports))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to query stale tally records: %v", err), errorStatus(err))
+		return
+	}
+	var pending []refreshTask
+	for i, key := range keys {
+		record := records[i]
+		if record.CommentID == 0 || record.Disabled || record.Frozen || record.Final != "" {
+			continue
+		}
+		name := key.Parent().StringID()
+		if len(allowedRepos) > 0 && !allowedRepos[name] {
+			continue
+		}
+		parts := strings.SplitN(name, "/", 2)
+		if len(parts) != 2 || strings.HasPrefix(name, "gitlab:") {
+			continue
+		}
+		pending = append(pending, refreshTask{Owner: parts[0], Repo: parts[1], Number: int(key.IntID()), Force: true})
+	}
+	if err := queueRefreshes(ctx, pending); err != nil {
+		http.Error(w, fmt.Sprintf("Failed to queue refreshes: %v", err), errorStatus(err))
+		return
+	}
+	fmt.Fprintf(w, "Queued %d stale reports\n", len(pending))
+}
@@ -0,0 +1,251 @@
+package robotally
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-github/github"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/taskqueue"
+)
+
+// captureTasks replaces the task queue for the duration of a test, collecting
+// the parameters of the queued tasks instead.
+func captureTasks(t *testing.T) *[]url.Values {
+	old := enqueue
+	t.Cleanup(func() { enqueue = old })
+
+	var queued []url.Values
+	enqueue = func(ctx context.Context, tasks []*taskqueue.Task) error {
+		if len(tasks) > maxTaskBatch {
+			t.Errorf("task batch too large: have %d, max %d", len(tasks), maxTaskBatch)
+		}
+		for _, task := range tasks {
+			params, err := url.ParseQuery(string(task.Payload))
+			if err != nil || task.Path != "/tasks/refresh" {
+				t.Errorf("invalid task: %s %q", task.Path, task.Payload)
+			}
+			queued = append(queued, params)
+		}
+		return nil
+	}
+	return &queued
+}
+
+// Tests that reprocessing a repository queues a refresh for each of its open
+// pull requests, across all pages of the listing.
+func TestReprocessQueuesEachPR(t *testing.T) {
+	defer func(old string) { adminSecret = old }(adminSecret)
+	adminSecret = "secret"
+
+	var first, second []*github.PullRequest
+	for number := 1; number <= 100; number++ {
+		first = append(first, &github.PullRequest{Number: github.Int(number)})
+	}
+	second = append(second, &github.PullRequest{Number: github.Int(101)}, &github.PullRequest{Number: github.Int(102)})
+
+	useTestAPI(t, map[string]http.HandlerFunc{
+		"GET /repos/owner/repo/pulls": func(w http.ResponseWriter, r *http.Request) {
+			if state := r.URL.Query().Get("state"); state != "open" {
+				t.Errorf("pull request state mismatch: have %s, want open", state)
+			}
+			replyPages(w, r, first, second)
+		},
+	})
+	queued := captureTasks(t)
+
+	req := httptest.NewRequest("POST", "/reprocess?owner=owner&repo=repo", nil)
+	req.Header.Set("X-Admin-Secret", "secret")
+	rec := httptest.NewRecorder()
+	reprocessHandler(rec, req)
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("reprocess failed: %d %s", rec.Code, rec.Body)
+	}
+	if len(*queued) != 102 {
+		t.Fatalf("queued task count mismatch: have %d, want %d", len(*queued), 102)
+	}
+	for i, params := range *queued {
+		if params.Get("owner") != "owner" || params.Get("repo") != "repo" || params.Get("number") != fmt.Sprint(i+1) || params.Get("force") != "false" {
+			t.Errorf("task %d mismatch: %v", i, params)
+		}
+	}
+	// Requests without the admin secret must not queue anything
+	req = httptest.NewRequest("POST", "/reprocess?owner=owner&repo=repo", nil)
+	rec = httptest.NewRecorder()
+	reprocessHandler(rec, req)
+
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("unauthorized reprocess status mismatch: have %d, want %d", rec.Code, http.StatusUnauthorized)
+	}
+}
+
+// Tests that a queued refresh task rebuilds the report of its pull request.
+func TestRefreshTaskUpdatesReport(t *testing.T) {
+	pr := &fakePR{Number: 331, Author: "author", Comments: []*github.IssueComment{
+		newComment(1, githubUser, summaryMarker+"\n\nstale report", 0),
+		newComment(2, "alice", ":+1:", time.Minute),
+	}}
+	useTestAPI(t, pr.install(make(map[string]http.HandlerFunc)))
+
+	req := newRequest(t, "POST", "/tasks/refresh", strings.NewReader("owner=owner&repo=repo&number=331&force=false"))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("X-Appengine-Queuename", "default")
+
+	rec := httptest.NewRecorder()
+	refreshTaskHandler(rec, req)
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("refresh task failed: %d %s", rec.Code, rec.Body)
+	}
+	if report := pr.Edited[1]; !strings.Contains(report, "| :+1: | 1 | @alice |") {
+		t.Errorf("report not refreshed:\n%s", report)
+	}
+}
+
+// Tests that an admin can request the processing outcome of a webhook as JSON,
+// including the tallied vote counts.
+func TestDebugOutcome(t *testing.T) {
+	defer func(old string) { adminSecret = old }(adminSecret)
+	adminSecret = "secret"
+
+	pr := &fakePR{Number: 341, Author: "author", Comments: []*github.IssueComment{
+		newComment(1, githubUser, summaryMarker+"\n\nstale report", 0),
+		newComment(2, "alice", ":+1:", time.Minute),
+		newComment(3, "bob", ":+1:", 2*time.Minute),
+		newComment(4, "carol", ":-1:", 3*time.Minute),
+	}}
+	useTestAPI(t, pr.install(make(map[string]http.HandlerFunc)))
+
+	body, _ := json.Marshal(&Event{
+		Action:     "created",
+		Repository: testRepo,
+		Issue:      &Issue{Number: 341, PullRequest: &IssueLink{}},
+		Comment:    &Comment{ID: 4, Body: ":-1:", User: &User{Login: "carol"}},
+		Sender:     &User{Login: "carol"},
+	})
+	req := newRequest(t, "POST", "/", bytes.NewReader(body))
+	req.Header.Set("X-Robotally-Debug", "1")
+	req.Header.Set("X-Admin-Secret", "secret")
+
+	rec := httptest.NewRecorder()
+	handler(rec, req)
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("event processing failed: %d %s", rec.Code, rec.Body)
+	}
+	out := new(outcome)
+	if err := json.NewDecoder(rec.Body).Decode(out); err != nil {
+		t.Fatalf("failed to decode outcome: %v", err)
+	}
+	if want := (outcome{Action: "updated", Up: 2, Down: 1, CommentID: 1}); *out != want {
+		t.Errorf("outcome mismatch: have %+v, want %+v", *out, want)
+	}
+}
+
+// Tests that the self test reports a GitHub token failing to authenticate, and
+// the access to the requested repositories otherwise.
+func TestSelftest(t *testing.T) {
+	defer func(old string) { adminSecret = old }(adminSecret)
+	adminSecret = "secret"
+
+	authenticated := false
+	useTestAPI(t, map[string]http.HandlerFunc{
+		"GET /user": func(w http.ResponseWriter, r *http.Request) {
+			if !authenticated {
+				w.WriteHeader(http.StatusUnauthorized)
+				reply(w, map[string]string{"message": "Bad credentials"})
+				return
+			}
+			w.Header().Set("X-OAuth-Scopes", "repo")
+			reply(w, &github.User{Login: github.String(githubUser)})
+		},
+		"GET /repos/owner/repo": func(w http.ResponseWriter, r *http.Request) {
+			reply(w, &github.Repository{Permissions: &map[string]bool{"pull": true, "push": true, "admin": false}})
+		},
+	})
+	selftest := func() *httptest.ResponseRecorder {
+		req := newRequest(t, "GET", "/selftest?repo=owner/repo", nil)
+		req.Header.Set("X-Admin-Secret", "secret")
+
+		rec := httptest.NewRecorder()
+		selftestHandler(rec, req)
+		return rec
+	}
+	if rec := selftest(); rec.Code != http.StatusBadGateway || !strings.Contains(rec.Body.String(), "Bad credentials") {
+		t.Errorf("authentication failure not reported: %d %s", rec.Code, rec.Body)
+	}
+	authenticated = true
+
+	rec := selftest()
+	if rec.Code != http.StatusOK {
+		t.Fatalf("self test failed: %d %s", rec.Code, rec.Body)
+	}
+	for _, want := range []string{"Authenticated as " + githubUser, "Token scopes: repo", "owner/repo: accessible, permissions: pull push"} {
+		if !strings.Contains(rec.Body.String(), want) {
+			t.Errorf("self test output missing %q:\n%s", want, rec.Body)
+		}
+	}
+}
+
+// Tests that the cron job queues a forced refresh of every stale report still
+// open for tallying, whichever repository it is in, skipping all others.
+func TestCronQueuesStaleReports(t *testing.T) {
+	defer func(old time.Duration) { staleReports = old }(staleReports)
+	staleReports = 24 * time.Hour
+
+	ctx := newContext(t)
+	stale, fresh := now().Add(-48*time.Hour), now().Add(-time.Hour)
+
+	records := map[int]Record{
+		1: {CommentID: 1, Updated: stale},
+		2: {CommentID: 2, Updated: fresh},
+		3: {Updated: stale},
+		4: {CommentID: 4, Updated: stale, Disabled: true},
+		5: {CommentID: 5, Updated: stale, Final: "Merged"},
+		6: {CommentID: 6, Updated: stale, Final: "Closed without merge", Frozen: true},
+		7: {CommentID: 7, Updated: stale.Add(-time.Hour)},
+	}
+	for number, record := range records {
+		record := record
+		if err := updateRecord(ctx, "cron/repo", number, func(stored *Record) { *stored = record }); err != nil {
+			t.Fatalf("failed to store record: %v", err)
+		}
+	}
+	if err := updateRecord(ctx, "gitlab:cron/repo", 8, func(stored *Record) { *stored = Record{CommentID: 8, Updated: stale} }); err != nil {
+		t.Fatalf("failed to store record: %v", err)
+	}
+	queued := captureTasks(t)
+
+	req := newRequest(t, "GET", "/cron/refresh", nil)
+	req.Header.Set("X-Appengine-Cron", "true")
+	rec := httptest.NewRecorder()
+	cronHandler(rec, req)
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("cron refresh failed: %d %s", rec.Code, rec.Body)
+	}
+	var numbers []string
+	for _, params := range *queued {
+		if params.Get("owner") != "cron" {
+			continue // Stale records of other tests
+		}
+		if params.Get("repo") != "repo" || params.Get("force") != "true" {
+			t.Errorf("task mismatch: %v", params)
+		}
+		numbers = append(numbers, params.Get("number"))
+	}
+	sort.Strings(numbers)
+	if want := []string{"1", "7"}; !reflect.DeepEqual(numbers, want) {
+		t.Errorf("refreshed pull requests mismatch: have %v, want %v", numbers, want)
+	}
+}
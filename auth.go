@@ -6,5 +6,31 @@ const (
 	githubToken = ""          // User's auth token to access the GitHub APIs
 )
 
+// GitHub API endpoint to access, e.g. that of a GitHub Enterprise instance.
+var githubURL = "https://api.github.com/"
+
+// Configure the GitLab credentials, used for merge request webhooks
+const gitlabUser = "robotally" // User to aggregate the reviews with
+
+var (
+	gitlabURL   = "https://gitlab.com" // GitLab instance to access the APIs of
+	gitlabToken = ""                   // User's access token to access the GitLab APIs (empty = GitLab disabled)
+)
+
+// Secret token GitLab webhooks need to send (required, GitLab events are rejected
+// without one).
+var gitlabSecret = ""
+
 // Allowed GitHub secrets for preventing rogue requests (empty = allow all).
 var githubSecrets = map[string][]byte{}
+
+// Repositories (owner/name) whose events are processed, to avoid acting on any
+// foreign ones from stray webhooks (empty = allow all).
+var allowedRepos = map[string]bool{}
+
+// GitLab projects (namespace/name) whose events are processed, kept apart from
+// the GitHub repositories as the two share no namespace (empty = allow all).
+var allowedProjects = map[string]bool{}
+
+// Shared secret for accessing the admin endpoints (empty = disabled).
+var adminSecret = ""
@@ -0,0 +1,303 @@
+package robotally
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+
+	"github.com/google/go-github/github"
+	"golang.org/x/net/context"
+)
+
+// checkName is the name of the check run maintained on each pull request.
+const checkName = "robotally"
+
+// conclusion maps the review votes of a tally onto a check run conclusion (success,
+// failure or neutral), along with the list of conditions still unmet for it,
+// including the missing approvals of any required teams.
+//
+// By default reaching the threshold in net upvotes passes the PR and a net
+// negative vote fails it. In consensus mode the threshold must be reached in
+// upvotes and any downvote fails the PR. Otherwise the result is neutral.
+// If a reviewer ratio is configured, it replaces the threshold with upvotes
+// from the required fraction of the requested reviewers.
+//
+// Outside of consensus mode an even split of up and down votes is resolved as
+// configured, either passing, failing or leaving the check neutral, regardless
+// of the net threshold.
+func conclusion(t *tally) (string, []string) {
+	up, down := 0, 0
+	for _, yes := range t.Votes {
+		if yes {
+			up++
+		} else {
+			down++
+		}
+	}
+	// Gather all the unmet conditions for approval
+	var unmet []string
+	if reviewerRatio > 0 {
+		if approved, need := approvals(t); approved < need {
+			unmet = append(unmet, fmt.Sprintf("%d more reviewer approvals needed", need-approved))
+		}
+		if consensus && down > 0 {
+			unmet = append(unmet, fmt.Sprintf("%d downvotes outstanding", down))
+		}
+	} else if consensus {
+		if up < threshold {
+			unmet = append(unmet, fmt.Sprintf("%d more upvotes needed", threshold-up))
+		}
+		if down > 0 {
+			unmet = append(unmet, fmt.Sprintf("%d downvotes outstanding", down))
+		}
+	} else if tied(up, down) {
+		if tieVotes != "pass" {
+			unmet = append(unmet, "votes are tied")
+		}
+	} else if up-down < threshold {
+		unmet = append(unmet, fmt.Sprintf("%d more net upvotes needed", threshold-(up-down)))
+	}
+	if testedRequired && len(t.Reactions[testedEmoji]) == 0 {
+		unmet = append(unmet, "not tested yet")
+	}
+	if len(t.Missing) > 0 {
+		unmet = append(unmet, "approval needed from "+strings.Join(t.Missing, " "))
+	}
+	// Pass if all conditions are met, fail if the votes are against
+	switch {
+	case len(unmet) == 0:
+		return "success", nil
+	case consensus && down > 0, !consensus && up < down:
+		return "failure", unmet
+	case !consensus && reviewerRatio == 0 && tied(up, down) && tieVotes == "fail":
+		return "failure", unmet
+	default:
+		return "neutral", unmet
+	}
+}
+
+// checkRun is a check run as accepted and returned by the checks API.
+type checkRun struct {
+	ID         int    `json:"id,omitempty"`
+	Name       string `json:"name"`
+	HeadSHA    string `json:"head_sha,omitempty"`
+	Status     string `json:"status"`
+	Conclusion string `json:"conclusion"`
+	Output     struct {
+		Title   string `json:"title"`
+		Summary string `json:"summary"`
+	} `json:"output"`
+}
+
+// publishCheck creates or updates the check run on the head commit of a pull
+// request, concluding it from the votes of the tally and summarizing it with the
+// rendered report. The run is tracked in the PR's tally record, so that later
+// tallies of the same commit update it instead of adding new ones. The endpoints
+// are not wrapped by the API client, so they're called directly.
+func publishCheck(ctx context.Context, client *github.Client, owner, repo string, number int, record *Record, t *tally, report string) error {
+	// Assemble the check run contents from the aggregated votes
+	result, _ := conclusion(t)
+
+	up, down := 0, 0
+	for _, yes := range t.Votes {
+		if yes {
+			up++
+		} else {
+			down++
+		}
+	}
+	run := &checkRun{Name: checkName, Status: "completed", Conclusion: result}
+	run.Output.Title, run.Output.Summary = fmt.Sprintf("%d upvotes, %d downvotes", up, down), report
+	if state := agreement(up, down); state != "" {
+		run.Output.Title += " (" + state + ")"
+	}
+	// Update the previous check run if it was published on the same commit
+	if record.CheckRun != 0 && record.CheckCommit == t.Commit {
+		req, err := client.NewRequest("PATCH", fmt.Sprintf("repos/%v/%v/check-runs/%d", owner, repo, record.CheckRun), run)
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Accept", "application/vnd.github.antiope-preview+json")
+
+		if _, err = client.Do(req, nil); !notFound(err) {
+			return err
+		}
+	}
+	run.HeadSHA = t.Commit
+
+	req, err := client.NewRequest("POST", fmt.Sprintf("repos/%v/%v/check-runs", owner, repo), run)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/vnd.github.antiope-preview+json")
+
+	created := new(checkRun)
+	if _, err := client.Do(req, created); err != nil {
+		return err
+	}
+	record.CheckRun, record.CheckCommit = created.ID, t.Commit
+	return setCheckRun(ctx, owner+"/"+repo, number, created.ID, t.Commit)
+}
+
+// approvals counts the requested reviewers of a tally who upvoted, along with the
+// number of them needed to reach the configured reviewer ratio (at least one). A
+// requested team counts as a single reviewer, approving if any member upvoted.
+func approvals(t *tally) (int, int) {
+	approved := 0
+	for _, reviewer := range t.Reviewers {
+		members, team := t.Teams[reviewer]
+		if !team {
+			members = []string{reviewer}
+		}
+		for _, user := range members {
+			if t.Votes[user] {
+				approved++
+				break
+			}
+		}
+	}
+	need := int(math.Ceil(reviewerRatio * float64(len(t.Reviewers))))
+	if need < 1 {
+		need = 1
+	}
+	return approved, need
+}
+
+// requestedReviewers retrieves the users and org/team teams whose review is
+// requested on a pull request if a reviewer ratio is configured, resolving the
+// members of the teams into the provided cache. The endpoint is not wrapped by
+// the API client, so it's called directly.
+func requestedReviewers(client *github.Client, owner, repo string, number int, cache map[string][]string) ([]string, map[string][]string, error) {
+	if reviewerRatio == 0 {
+		return nil, nil, nil
+	}
+	req, err := client.NewRequest("GET", fmt.Sprintf("repos/%v/%v/pulls/%d/requested_reviewers", owner, repo, number), nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	req.Header.Set("Accept", "application/vnd.github.black-cat-preview+json")
+
+	requested := new(struct {
+		Users []*github.User `json:"users"`
+		Teams []*github.Team `json:"teams"`
+	})
+	if _, err := client.Do(req, requested); err != nil {
+		return nil, nil, err
+	}
+	var reviewers []string
+	for _, user := range requested.Users {
+		if user := login(user); user != "" {
+			reviewers = append(reviewers, user)
+		}
+	}
+	teams := make(map[string][]string)
+	for _, team := range requested.Teams {
+		if team.Slug == nil {
+			continue
+		}
+		name := owner + "/" + *team.Slug
+		members, err := resolveTeam(client, name, cache)
+		if err != nil {
+			return nil, nil, err
+		}
+		reviewers, teams[name] = append(reviewers, name), members
+	}
+	sort.Strings(reviewers)
+	return reviewers, teams, nil
+}
+
+// enforceReview submits a changes requested review on a pull request while it
+// has blocking downvotes, dismissing it again once all of them are removed. The
+// review is tracked in the PR's tally record to dismiss the right one, noting
+// both actions in its audit trail.
+func enforceReview(ctx context.Context, client *github.Client, owner, repo string, number int, record *Record, votes map[string]bool) error {
+	var blockers []string
+	for user, yes := range votes {
+		if !yes {
+			blockers = append(blockers, "@"+user)
+		}
+	}
+	sort.Strings(blockers)
+
+	switch {
+	case len(blockers) > 0 && record.ReviewID == 0:
+		review, _, err := client.PullRequests.CreateReview(owner, repo, number, &github.PullRequestReviewRequest{
+			Body:  github.String("Blocked by downvotes from " + strings.Join(blockers, " ")),
+			Event: github.String("REQUEST_CHANGES"),
+		})
+		if err != nil {
+			return err
+		}
+		if err := setReviewID(ctx, owner+"/"+repo, number, *review.ID); err != nil {
+			return err
+		}
+		return audit(ctx, owner+"/"+repo, number, record, fmt.Sprintf("Requested changes at %d downvotes", len(blockers)))
+
+	case len(blockers) == 0 && record.ReviewID != 0:
+		_, _, err := client.PullRequests.DismissReview(owner, repo, number, record.ReviewID, &github.PullRequestReviewDismissalRequest{
+			Message: github.String("All blocking downvotes were removed"),
+		})
+		if err != nil && !notFound(err) {
+			return err
+		}
+		if err := setReviewID(ctx, owner+"/"+repo, number, 0); err != nil {
+			return err
+		}
+		return audit(ctx, owner+"/"+repo, number, record, "Dismissed the changes requested review")
+	}
+	return nil
+}
+
+// nudge requests a review from the configured reviewers who haven't voted yet on
+// a pull request older than the nudge age. Each reviewer is requested only once,
+// tracked in the PR's tally record, and the request is noted in its audit trail.
+// Reviewers GitHub refuses to request (e.g. non-collaborators) are tracked too,
+// so their request is not retried on every event.
+func nudge(ctx context.Context, client *github.Client, owner, repo string, pr *github.PullRequest, record *Record, votes map[string]bool) error {
+	if len(nudgeReviewers) == 0 || nudgeAfter == 0 || pr.CreatedAt == nil || now().Sub(*pr.CreatedAt) < nudgeAfter {
+		return nil
+	}
+	requested := make(map[string]bool)
+	for _, user := range record.Requested {
+		requested[user] = true
+	}
+	var pending []string
+	for _, user := range nudgeReviewers {
+		if _, voted := votes[user]; !voted && !requested[user] && user != login(pr.User) {
+			pending = append(pending, user)
+		}
+	}
+	if len(pending) == 0 {
+		return nil
+	}
+	note := "Requested reviews from @" + strings.Join(pending, " @")
+	if err := requestReviewers(client, owner, repo, *pr.Number, pending); err != nil {
+		if _, ok := classify(err).(*permanentError); !ok {
+			return err
+		}
+		note = "Failed to request reviews from @" + strings.Join(pending, " @")
+	}
+	record.Requested = append(record.Requested, pending...)
+	if err := updateRecord(ctx, owner+"/"+repo, *pr.Number, func(stored *Record) {
+		stored.Requested = append(stored.Requested, pending...)
+	}); err != nil {
+		return err
+	}
+	return audit(ctx, owner+"/"+repo, *pr.Number, record, note)
+}
+
+// requestReviewers requests a review on a pull request from the given users. The
+// endpoint is not wrapped by the API client, so it's called directly.
+func requestReviewers(client *github.Client, owner, repo string, number int, users []string) error {
+	req, err := client.NewRequest("POST", fmt.Sprintf("repos/%v/%v/pulls/%d/requested_reviewers", owner, repo, number), &struct {
+		Reviewers []string `json:"reviewers"`
+	}{users})
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/vnd.github.black-cat-preview+json")
+
+	_, err = client.Do(req, nil)
+	return err
+}
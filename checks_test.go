@@ -0,0 +1,381 @@
+package robotally
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-github/github"
+)
+
+// Tests that the review votes of a tally are mapped onto the correct approval
+// verdict in the default net vote mode.
+func TestConclusion(t *testing.T) {
+	tests := []struct {
+		votes  map[string]bool
+		result string
+		unmet  []string
+	}{
+		{nil, "neutral", []string{"2 more net upvotes needed"}},
+		{map[string]bool{"alice": true}, "neutral", []string{"1 more net upvotes needed"}},
+		{map[string]bool{"alice": true, "bob": true}, "success", nil},
+		{map[string]bool{"alice": true, "bob": true, "carol": true, "dave": false}, "success", nil},
+		{map[string]bool{"alice": true, "bob": true, "carol": false}, "neutral", []string{"1 more net upvotes needed"}},
+		{map[string]bool{"alice": false}, "failure", []string{"3 more net upvotes needed"}},
+	}
+	for i, tt := range tests {
+		result, unmet := conclusion(&tally{Votes: tt.votes})
+		if result != tt.result {
+			t.Errorf("test %d: conclusion mismatch: have %s, want %s", i, result, tt.result)
+		}
+		if !reflect.DeepEqual(unmet, tt.unmet) {
+			t.Errorf("test %d: unmet conditions mismatch: have %v, want %v", i, unmet, tt.unmet)
+		}
+	}
+}
+
+// Tests that the vote state of a pull request is published as a check run on its
+// head commit, concluded from the votes and updated in place as they change.
+func TestCheckRunPublished(t *testing.T) {
+	defer func(old bool) { checkRuns = old }(checkRuns)
+	checkRuns = true
+
+	ctx := newContext(t)
+	pr := &fakePR{Number: 326, Author: "author", Comments: []*github.IssueComment{
+		newComment(1, githubUser, summaryMarker+"\n\nstale report", 0),
+		newComment(2, "alice", ":+1:", time.Minute),
+		newComment(3, "bob", ":+1:", 2*time.Minute),
+	}}
+	var runs []*checkRun
+	routes := pr.install(map[string]http.HandlerFunc{
+		"POST /repos/owner/repo/check-runs": func(w http.ResponseWriter, r *http.Request) {
+			run := new(checkRun)
+			json.NewDecoder(r.Body).Decode(run)
+			runs = append(runs, run)
+			reply(w, &checkRun{ID: 55, Name: run.Name})
+		},
+		"PATCH /repos/owner/repo/check-runs/55": func(w http.ResponseWriter, r *http.Request) {
+			run := new(checkRun)
+			json.NewDecoder(r.Body).Decode(run)
+			run.ID = 55
+			runs = append(runs, run)
+			reply(w, run)
+		},
+	})
+	client := newTestClient(t, routes)
+
+	tests := []struct {
+		voter      string
+		vote       string
+		conclusion string
+		title      string
+	}{
+		{"", "", "success", "2 upvotes, 0 downvotes (consensus)"},
+		{"carol", ":-1:", "neutral", "2 upvotes, 1 downvotes (contested)"},
+		{"dave", ":-1:", "neutral", "2 upvotes, 2 downvotes (tied)"},
+		{"erin", ":-1:", "failure", "2 upvotes, 3 downvotes (contested)"},
+	}
+	for i, tt := range tests {
+		if tt.voter != "" {
+			pr.Comments = append(pr.Comments, newComment(10+i, tt.voter, tt.vote, time.Duration(10+i)*time.Minute))
+		}
+		if _, err := refresh(ctx, client, "owner", "repo", 326, false, false); err != nil {
+			t.Fatalf("test %d: failed to refresh report: %v", i, err)
+		}
+		if len(runs) != i+1 {
+			t.Fatalf("test %d: check run publish count mismatch: have %d, want %d", i, len(runs), i+1)
+		}
+		run := runs[i]
+		if run.Name != checkName || run.Status != "completed" || run.Conclusion != tt.conclusion || run.Output.Title != tt.title {
+			t.Errorf("test %d: check run mismatch: have %s %s %s %q, want %s completed %s %q", i, run.Name, run.Status, run.Conclusion, run.Output.Title, checkName, tt.conclusion, tt.title)
+		}
+		if run.Output.Summary != pr.Edited[1] {
+			t.Errorf("test %d: check run summary mismatch:\nhave:\n%s\nwant:\n%s", i, run.Output.Summary, pr.Edited[1])
+		}
+		// Only the first run is created on the head commit, the rest updating it
+		if want := map[bool]string{true: "0123456789abcdef", false: ""}[i == 0]; run.HeadSHA != want {
+			t.Errorf("test %d: check run commit mismatch: have %q, want %q", i, run.HeadSHA, want)
+		}
+	}
+	// Refreshing without any vote changes must not republish the check run
+	if _, err := refresh(ctx, client, "owner", "repo", 326, false, false); err != nil {
+		t.Fatalf("failed to refresh report: %v", err)
+	}
+	if len(runs) != len(tests) {
+		t.Errorf("unchanged check run republished: have %d publishes, want %d", len(runs), len(tests))
+	}
+}
+
+// Tests that the consensus mode needs the threshold in upvotes without a single
+// downvote, reporting each unmet condition separately.
+func TestConsensusConclusion(t *testing.T) {
+	defer func(old bool) { consensus = old }(consensus)
+	consensus = true
+
+	tests := []struct {
+		votes  map[string]bool
+		result string
+		unmet  []string
+	}{
+		{map[string]bool{"alice": true}, "neutral", []string{"1 more upvotes needed"}},
+		{map[string]bool{"alice": true, "bob": true, "carol": false}, "failure", []string{"1 downvotes outstanding"}},
+		{map[string]bool{"alice": false, "bob": false}, "failure", []string{"2 more upvotes needed", "2 downvotes outstanding"}},
+		{map[string]bool{"alice": true, "bob": true}, "success", nil},
+		{map[string]bool{"alice": true, "bob": true, "carol": true}, "success", nil},
+	}
+	for i, tt := range tests {
+		result, unmet := conclusion(&tally{Votes: tt.votes})
+		if result != tt.result {
+			t.Errorf("test %d: conclusion mismatch: have %s, want %s", i, result, tt.result)
+		}
+		if !reflect.DeepEqual(unmet, tt.unmet) {
+			t.Errorf("test %d: unmet conditions mismatch: have %v, want %v", i, unmet, tt.unmet)
+		}
+	}
+}
+
+// Tests that a changes requested review is submitted while a pull request has
+// blocking downvotes, and dismissed once they are all removed.
+func TestEnforceReviewLifecycle(t *testing.T) {
+	ctx := newContext(t)
+
+	var submitted, dismissed int
+	client := newTestClient(t, map[string]http.HandlerFunc{
+		"POST /repos/owner/repo/pulls/340/reviews": func(w http.ResponseWriter, r *http.Request) {
+			submitted++
+			review := new(github.PullRequestReviewRequest)
+			json.NewDecoder(r.Body).Decode(review)
+			if review.Event == nil || *review.Event != "REQUEST_CHANGES" || review.Body == nil || !strings.Contains(*review.Body, "@bob") {
+				t.Errorf("invalid review submitted: %+v", review)
+			}
+			reply(w, &github.PullRequestReview{ID: github.Int(77)})
+		},
+		"PUT /repos/owner/repo/pulls/340/reviews/77/dismissals": func(w http.ResponseWriter, r *http.Request) {
+			dismissed++
+			reply(w, &github.PullRequestReview{ID: github.Int(77)})
+		},
+	})
+	// Block the PR and ensure the review is submitted only once
+	for i := 0; i < 2; i++ {
+		record, err := loadRecord(ctx, "owner/repo", 340)
+		if err != nil {
+			t.Fatalf("failed to load record: %v", err)
+		}
+		if err := enforceReview(ctx, client, "owner", "repo", 340, record, map[string]bool{"alice": true, "bob": false}); err != nil {
+			t.Fatalf("failed to request changes: %v", err)
+		}
+	}
+	record, err := loadRecord(ctx, "owner/repo", 340)
+	if err != nil {
+		t.Fatalf("failed to load record: %v", err)
+	}
+	if submitted != 1 || record.ReviewID != 77 {
+		t.Fatalf("review submission mismatch: have %d submitted as %d, want 1 as 77", submitted, record.ReviewID)
+	}
+	// Unblock the PR and ensure the review is dismissed
+	if err := enforceReview(ctx, client, "owner", "repo", 340, record, map[string]bool{"alice": true}); err != nil {
+		t.Fatalf("failed to dismiss review: %v", err)
+	}
+	if record, err = loadRecord(ctx, "owner/repo", 340); err != nil {
+		t.Fatalf("failed to load record: %v", err)
+	}
+	if dismissed != 1 || record.ReviewID != 0 {
+		t.Errorf("review dismissal mismatch: have %d dismissed with %d pending, want 1 with none", dismissed, record.ReviewID)
+	}
+	if len(record.Audit) != 2 {
+		t.Errorf("audit note count mismatch: have %d, want %d", len(record.Audit), 2)
+	}
+}
+
+// Tests that an even split of votes is resolved as configured, whatever the net
+// threshold is.
+func TestTieVotes(t *testing.T) {
+	defer func(mode string, limit int) { tieVotes, threshold = mode, limit }(tieVotes, threshold)
+
+	tied := map[string]bool{"alice": true, "bob": false}
+	tests := []struct {
+		mode      string
+		threshold int
+		result    string
+		unmet     []string
+		state     string
+	}{
+		{"neutral", 2, "neutral", []string{"votes are tied"}, "tied"},
+		{"neutral", 0, "neutral", []string{"votes are tied"}, "tied"},
+		{"fail", 2, "failure", []string{"votes are tied"}, "tied, failing"},
+		{"fail", 0, "failure", []string{"votes are tied"}, "tied, failing"},
+		{"pass", 2, "success", nil, "tied, passing"},
+		{"pass", 0, "success", nil, "tied, passing"},
+	}
+	for i, tt := range tests {
+		tieVotes, threshold = tt.mode, tt.threshold
+
+		result, unmet := conclusion(&tally{Votes: tied})
+		if result != tt.result {
+			t.Errorf("test %d: conclusion mismatch: have %s, want %s", i, result, tt.result)
+		}
+		if !reflect.DeepEqual(unmet, tt.unmet) {
+			t.Errorf("test %d: unmet conditions mismatch: have %v, want %v", i, unmet, tt.unmet)
+		}
+		if state := agreement(1, 1); state != tt.state {
+			t.Errorf("test %d: review state mismatch: have %s, want %s", i, state, tt.state)
+		}
+	}
+	// A lone upvote short of the threshold is not a tie, so it must not pass
+	tieVotes, threshold = "pass", 2
+	if result, _ := conclusion(&tally{Votes: map[string]bool{"alice": true}}); result != "neutral" {
+		t.Errorf("lone upvote conclusion mismatch: have %s, want neutral", result)
+	}
+	// The resolved tie must be reflected in the published check run too
+	run := new(checkRun)
+	client := newTestClient(t, map[string]http.HandlerFunc{
+		"POST /repos/owner/repo/check-runs": func(w http.ResponseWriter, r *http.Request) {
+			json.NewDecoder(r.Body).Decode(run)
+			reply(w, &checkRun{ID: 352})
+		},
+	})
+	if err := publishCheck(newContext(t), client, "owner", "repo", 352, new(Record), &tally{Votes: tied, Commit: "0123456789abcdef"}, "report"); err != nil {
+		t.Fatalf("failed to publish check run: %v", err)
+	}
+	if run.Conclusion != "success" || run.Output.Title != "1 upvotes, 1 downvotes (tied, passing)" {
+		t.Errorf("passing tie check run mismatch: have %s %q, want success %q", run.Conclusion, run.Output.Title, "1 upvotes, 1 downvotes (tied, passing)")
+	}
+}
+
+// Tests that an automated action taken during a refresh is noted in the report
+// rendered right away, and persisted for later ones.
+func TestAuditNote(t *testing.T) {
+	defer func(reviewers []string, after time.Duration, clock func() time.Time) {
+		nudgeReviewers, nudgeAfter, now = reviewers, after, clock
+	}(nudgeReviewers, nudgeAfter, now)
+	nudgeReviewers, nudgeAfter = []string{"bob"}, time.Hour
+	now = func() time.Time { return testTime.Add(2 * time.Hour) }
+
+	pr := &fakePR{Number: 359, Author: "author", Comments: []*github.IssueComment{
+		newComment(1, githubUser, summaryMarker+"\n\nstale report", 0),
+		newComment(2, "alice", ":+1:", time.Minute),
+	}}
+	routes := pr.install(make(map[string]http.HandlerFunc))
+	routes["POST /repos/owner/repo/pulls/359/requested_reviewers"] = func(w http.ResponseWriter, r *http.Request) {
+		reply(w, &github.PullRequest{Number: github.Int(359)})
+	}
+	useTestAPI(t, routes)
+
+	ctx := newContext(t)
+	if _, err := refresh(ctx, newClient(ctx), "owner", "repo", 359, false, false); err != nil {
+		t.Fatalf("failed to refresh: %v", err)
+	}
+	note := "_Robotally: Requested reviews from @bob on " + now().UTC().Format("Mon Jan 2 15:04:05 MST 2006") + "_"
+	if !strings.Contains(pr.Edited[1], note) {
+		t.Errorf("audit note %q missing:\n%s", note, pr.Edited[1])
+	}
+	record, err := loadRecord(ctx, "owner/repo", 359)
+	if err != nil {
+		t.Fatalf("failed to load record: %v", err)
+	}
+	if len(record.Audit) != 1 || !strings.Contains(note, record.Audit[0]) {
+		t.Errorf("audit note not persisted: %v", record.Audit)
+	}
+}
+
+// Tests that the reviewers who haven't voted are requested only once, even if
+// GitHub refuses to request some of them.
+func TestNudgeRequestsOnce(t *testing.T) {
+	defer func(reviewers []string, after time.Duration) { nudgeReviewers, nudgeAfter = reviewers, after }(nudgeReviewers, nudgeAfter)
+	nudgeReviewers, nudgeAfter = []string{"alice", "bob", "carol"}, time.Hour
+
+	ctx := newContext(t)
+	calls := map[int]int{}
+	client := newTestClient(t, map[string]http.HandlerFunc{
+		"POST /repos/owner/repo/pulls/371/requested_reviewers": func(w http.ResponseWriter, r *http.Request) {
+			calls[371]++
+			request := new(struct {
+				Reviewers []string `json:"reviewers"`
+			})
+			json.NewDecoder(r.Body).Decode(request)
+			if want := []string{"bob", "carol"}; !reflect.DeepEqual(request.Reviewers, want) {
+				t.Errorf("requested reviewers mismatch: have %v, want %v", request.Reviewers, want)
+			}
+			reply(w, &github.PullRequest{Number: github.Int(371)})
+		},
+		"POST /repos/owner/repo/pulls/372/requested_reviewers": func(w http.ResponseWriter, r *http.Request) {
+			calls[372]++
+			w.WriteHeader(http.StatusUnprocessableEntity)
+			reply(w, map[string]string{"message": "Reviews may only be requested from collaborators."})
+		},
+	})
+	created := now().Add(-2 * time.Hour)
+	for _, number := range []int{371, 372} {
+		pr := &github.PullRequest{Number: github.Int(number), User: &github.User{Login: github.String("dave")}, CreatedAt: &created}
+		for i := 0; i < 2; i++ {
+			record, err := loadRecord(ctx, "owner/repo", number)
+			if err != nil {
+				t.Fatalf("failed to load record: %v", err)
+			}
+			if err := nudge(ctx, client, "owner", "repo", pr, record, map[string]bool{"alice": true}); err != nil {
+				t.Fatalf("PR #%d: failed to nudge reviewers: %v", number, err)
+			}
+		}
+		if calls[number] != 1 {
+			t.Errorf("PR #%d: request count mismatch: have %d, want %d", number, calls[number], 1)
+		}
+		record, err := loadRecord(ctx, "owner/repo", number)
+		if err != nil {
+			t.Fatalf("failed to load record: %v", err)
+		}
+		if want := []string{"bob", "carol"}; !reflect.DeepEqual(record.Requested, want) {
+			t.Errorf("PR #%d: tracked reviewers mismatch: have %v, want %v", number, record.Requested, want)
+		}
+	}
+}
+
+// Tests that the reviewer ratio mode needs the configured fraction of requested
+// reviewers to upvote, requested teams counting as a single reviewer each.
+func TestReviewerRatio(t *testing.T) {
+	defer func(old float64) { reviewerRatio = old }(reviewerRatio)
+	reviewerRatio = 0.6
+
+	client := newTestClient(t, map[string]http.HandlerFunc{
+		"GET /repos/owner/repo/pulls/375/requested_reviewers": func(w http.ResponseWriter, r *http.Request) {
+			reply(w, map[string]interface{}{
+				"users": newUsers("alice", "bob", "carol", "dave"),
+				"teams": []*github.Team{{ID: github.Int(7), Slug: github.String("security")}},
+			})
+		},
+		"GET /orgs/owner/teams": func(w http.ResponseWriter, r *http.Request) {
+			reply(w, []*github.Team{{ID: github.Int(7), Slug: github.String("security")}})
+		},
+		"GET /teams/7/members": func(w http.ResponseWriter, r *http.Request) {
+			reply(w, newUsers("erin", "frank"))
+		},
+	})
+	reviewers, teams, err := requestedReviewers(client, "owner", "repo", 375, make(map[string][]string))
+	if err != nil {
+		t.Fatalf("failed to list requested reviewers: %v", err)
+	}
+	if want := []string{"alice", "bob", "carol", "dave", "owner/security"}; !reflect.DeepEqual(reviewers, want) {
+		t.Fatalf("requested reviewers mismatch: have %v, want %v", reviewers, want)
+	}
+	tests := []struct {
+		votes  map[string]bool
+		result string
+		report string
+	}{
+		{map[string]bool{"alice": true, "bob": true}, "neutral", "2/5 reviewers approved (need 3)"},
+		{map[string]bool{"alice": true, "bob": true, "carol": false, "mallory": true}, "neutral", "2/5 reviewers approved (need 3)"},
+		{map[string]bool{"alice": true, "bob": true, "frank": true}, "success", "3/5 reviewers approved (need 3)"},
+		{map[string]bool{"alice": true, "bob": true, "carol": true, "erin": true, "frank": true}, "success", "4/5 reviewers approved (need 3)"},
+	}
+	for i, tt := range tests {
+		state := &tally{Votes: tt.votes, Reviewers: reviewers, Teams: teams}
+		if result, _ := conclusion(state); result != tt.result {
+			t.Errorf("test %d: conclusion mismatch: have %s, want %s", i, result, tt.result)
+		}
+		if report := status(markdown, state); !strings.Contains(report, tt.report) {
+			t.Errorf("test %d: approvals missing from report: want %q\n%s", i, tt.report, report)
+		}
+	}
+}
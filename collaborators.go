@@ -0,0 +1,334 @@
+package robotally
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/google/go-github/github"
+)
+
+// collaboratorSet retrieves the set of users whose votes should be counted,
+// fetching them with a single list call per page based on the configured
+// strategy, regardless of the number of voters. A nil set is returned for
+// strategies that don't batch lookups.
+func collaboratorSet(client *github.Client, owner, repo string) (map[string]bool, error) {
+	if collaborators != "repo" && collaborators != "team" {
+		return nil, nil
+	}
+	set := make(map[string]bool)
+
+	opt := github.ListOptions{PerPage: 100}
+	for {
+		var (
+			users []*github.User
+			res   *github.Response
+			err   error
+		)
+		if collaborators == "repo" {
+			users, res, err = client.Repositories.ListCollaborators(owner, repo, &opt)
+		} else {
+			users, res, err = client.Organizations.ListTeamMembers(collaboratorTeam, &github.OrganizationListTeamMembersOptions{ListOptions: opt})
+		}
+		if err != nil {
+			return nil, err
+		}
+		for _, user := range users {
+			set[login(user)] = true
+		}
+		if res == nil || res.NextPage == 0 {
+			break
+		}
+		opt.Page = res.NextPage
+	}
+	delete(set, "")
+	return set, nil
+}
+
+// filterVoters drops the votes of all users not considered collaborators by
+// the configured strategy.
+func filterVoters(client *github.Client, owner, repo string, votes map[string]bool) error {
+	if collaborators == "" {
+		return nil
+	}
+	set, err := collaboratorSet(client, owner, repo)
+	if err != nil {
+		return err
+	}
+	for user := range votes {
+		// Check membership against the batch fetched set if available
+		if set != nil {
+			if !set[user] {
+				delete(votes, user)
+			}
+			continue
+		}
+		// Otherwise look up each voter individually
+		ok, _, err := client.Repositories.IsCollaborator(owner, repo, user)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			delete(votes, user)
+		}
+	}
+	return nil
+}
+
+// roles ranks the repository permission levels by the access they grant.
+var roles = map[string]int{"read": 1, "triage": 2, "write": 3, "maintain": 4, "admin": 5}
+
+// permission retrieves the repository role of a user, caching the lookups in
+// the provided map to avoid duplicate API calls within the same request.
+//
+// The fine grained role name (e.g. maintain or triage) is preferred, but it is
+// not decoded by go-github, so the permission level is requested directly. The
+// custom roles of organizations are not ranked, so they fall back to the base
+// permission they extend (read, write or admin).
+func permission(client *github.Client, owner, repo, user string, cache map[string]string) (string, error) {
+	if role, ok := cache[user]; ok {
+		return role, nil
+	}
+	req, err := client.NewRequest("GET", fmt.Sprintf("repos/%v/%v/collaborators/%v/permission", owner, repo, user), nil)
+	if err != nil {
+		return "", err
+	}
+	level := new(struct {
+		Permission string `json:"permission"`
+		RoleName   string `json:"role_name"`
+	})
+	if _, err := client.Do(req, level); err != nil {
+		return "", err
+	}
+	role := level.RoleName
+	if _, ok := roles[role]; !ok {
+		role = level.Permission
+	}
+	cache[user] = role
+	return role, nil
+}
+
+// splitAdvisory moves the votes of users below the configured minimum role out
+// of the binding votes and into a set of advisory ones.
+func splitAdvisory(client *github.Client, owner, repo string, votes map[string]bool, cache map[string]string) (map[string]bool, error) {
+	advisory := make(map[string]bool)
+	if minimumRole == "" {
+		return advisory, nil
+	}
+	for user, yes := range votes {
+		role, err := permission(client, owner, repo, user, cache)
+		if err != nil {
+			return nil, err
+		}
+		if roles[role] < roles[minimumRole] {
+			advisory[user] = yes
+			delete(votes, user)
+		}
+	}
+	return advisory, nil
+}
+
+// resolvers finds the users marking concerns resolved who hold at least the
+// maintain role, and as such may clear anyone's blocking downvote.
+func resolvers(client *github.Client, owner, repo string, comments []*github.IssueComment, cache map[string]string) (map[string]bool, error) {
+	maintainers := make(map[string]bool)
+	if resolvedEmoji == "" {
+		return maintainers, nil
+	}
+	for _, comment := range comments {
+		user := login(comment.User)
+		if automated(comment) || user == "" || !strings.Contains(comment.String(), resolvedEmoji) {
+			continue
+		}
+		role, err := permission(client, owner, repo, user, cache)
+		if err != nil {
+			return nil, err
+		}
+		if roles[role] >= roles["maintain"] {
+			maintainers[user] = true
+		}
+	}
+	return maintainers, nil
+}
+
+// teamMention matches an @org/team style mention of a GitHub team.
+var teamMention = regexp.MustCompile(`@([A-Za-z0-9-]+/[A-Za-z0-9_.-]+)`)
+
+// teamMembers resolves the members of all the teams mentioned in comments that
+// also cast a vote, caching the memberships in the provided map keyed by the
+// org/team name to avoid duplicate API calls within the same request.
+func teamMembers(client *github.Client, comments []*github.IssueComment, cache map[string][]string) (map[string][]string, error) {
+	if !expandTeams {
+		return cache, nil
+	}
+	for _, comment := range comments {
+		if automated(comment) || login(comment.User) == "" {
+			continue
+		}
+		text := ballot(comment)
+		if !strings.Contains(text, upvoteEmoji) && !strings.Contains(text, downvoteEmoji) {
+			continue
+		}
+		for _, match := range teamMention.FindAllStringSubmatch(text, -1) {
+			if _, err := resolveTeam(client, match[1], cache); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return cache, nil
+}
+
+// coApproval matches a co-approver mention following an upvote, e.g. the one in
+// `:+1: (with @alice)` for approving on behalf of a pairing colleague.
+var coApproval = regexp.MustCompile(regexp.QuoteMeta(upvoteEmoji) + `\s*\(with @([A-Za-z0-9-]+)\)`)
+
+// coApprovers gathers the users named as co-approvers of any upvote, retaining
+// only those who are collaborators of the repository.
+func coApprovers(client *github.Client, owner, repo string, comments []*github.IssueComment) (map[string]bool, error) {
+	partners := make(map[string]bool)
+	if !coApprovals {
+		return partners, nil
+	}
+	checked := make(map[string]bool)
+	for _, comment := range comments {
+		if automated(comment) || login(comment.User) == "" {
+			continue
+		}
+		for _, match := range coApproval.FindAllStringSubmatch(ballot(comment), -1) {
+			if checked[match[1]] {
+				continue
+			}
+			checked[match[1]] = true
+
+			ok, _, err := client.Repositories.IsCollaborator(owner, repo, match[1])
+			if err != nil {
+				return nil, err
+			}
+			partners[match[1]] = ok
+		}
+	}
+	return partners, nil
+}
+
+// resolveTeam retrieves the members of an org/team named team, caching them in
+// the provided map. Names not corresponding to any team resolve to no members.
+func resolveTeam(client *github.Client, name string, cache map[string][]string) ([]string, error) {
+	if members, ok := cache[name]; ok {
+		return members, nil
+	}
+	parts := strings.SplitN(name, "/", 2)
+	if len(parts) != 2 {
+		return nil, nil
+	}
+	// Look up the team among those of the organization, teams being addressed by ID
+	var team *github.Team
+
+	opt := &github.ListOptions{PerPage: 100}
+	for team == nil {
+		teams, res, err := client.Organizations.ListTeams(parts[0], opt)
+		if err != nil {
+			if notFound(err) {
+				break // Not an organization, just a weird mention
+			}
+			return nil, err
+		}
+		for _, candidate := range teams {
+			if candidate.Slug != nil && strings.EqualFold(*candidate.Slug, parts[1]) {
+				team = candidate
+				break
+			}
+		}
+		if res == nil || res.NextPage == 0 {
+			break
+		}
+		opt.Page = res.NextPage
+	}
+	if team == nil || team.ID == nil {
+		cache[name] = nil // Not a team, just a weird mention
+		return nil, nil
+	}
+	// Gather all the members of the team
+	cache[name] = nil
+
+	members := &github.OrganizationListTeamMembersOptions{ListOptions: github.ListOptions{PerPage: 100}}
+	for {
+		users, res, err := client.Organizations.ListTeamMembers(*team.ID, members)
+		if err != nil {
+			return nil, err
+		}
+		for _, user := range users {
+			if user := login(user); user != "" {
+				cache[name] = append(cache[name], user)
+			}
+		}
+		if res == nil || res.NextPage == 0 {
+			break
+		}
+		members.Page = res.NextPage
+	}
+	return cache[name], nil
+}
+
+// missingApprovals checks the files touched by a pull request against the team
+// rules, returning the required teams not yet having an upvote from a member.
+func missingApprovals(client *github.Client, owner, repo string, number int, votes map[string]bool, cache map[string][]string) ([]string, error) {
+	if len(teamRules) == 0 {
+		return nil, nil
+	}
+	// Gather all the files touched, as a rule may only match beyond the first page
+	var files []*github.CommitFile
+
+	opt := &github.ListOptions{PerPage: 100}
+	for {
+		page, res, err := client.PullRequests.ListFiles(owner, repo, number, opt)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, page...)
+		if res == nil || res.NextPage == 0 {
+			break
+		}
+		opt.Page = res.NextPage
+	}
+	var missing []string
+	for _, rule := range teamRules {
+		// Skip the rule if the pull request doesn't touch any matching files
+		touched := false
+		for _, file := range files {
+			if globMatch(rule.Pattern, *file.Filename) {
+				touched = true
+				break
+			}
+		}
+		if !touched {
+			continue
+		}
+		// Check whether any member of the team approved
+		members, err := resolveTeam(client, rule.Team, cache)
+		if err != nil {
+			return nil, err
+		}
+		approved := false
+		for _, member := range members {
+			if votes[member] {
+				approved = true
+				break
+			}
+		}
+		if !approved {
+			missing = append(missing, "@"+rule.Team)
+		}
+	}
+	return missing, nil
+}
+
+// globMatch reports whether a file path matches a glob pattern, where a trailing
+// "/**" matches everything within a directory.
+func globMatch(pattern, file string) bool {
+	if strings.HasSuffix(pattern, "/**") {
+		return strings.HasPrefix(file, strings.TrimSuffix(pattern, "**"))
+	}
+	ok, _ := path.Match(pattern, file)
+	return ok
+}
@@ -0,0 +1,256 @@
+package robotally
+
+import (
+	"fmt"
+	"net/http"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/google/go-github/github"
+)
+
+// newUsers creates a list of GitHub users with the given logins.
+func newUsers(logins ...string) []*github.User {
+	users := make([]*github.User, len(logins))
+	for i, login := range logins {
+		users[i] = &github.User{Login: github.String(login)}
+	}
+	return users
+}
+
+// Tests that filtering the votes by team membership fetches the members with a
+// single list call per page, however many voters there are.
+func TestFilterVotersSingleListCall(t *testing.T) {
+	defer func(strategy string, team int) { collaborators, collaboratorTeam = strategy, team }(collaborators, collaboratorTeam)
+	collaborators, collaboratorTeam = "team", 42
+
+	// Spread the team over two pages, with one voter from each and an outsider
+	var first, second []string
+	for i := 0; i < 100; i++ {
+		first = append(first, fmt.Sprintf("member-%d", i))
+	}
+	second = append(second, "member-100", "member-101")
+
+	calls := 0
+	client := newTestClient(t, map[string]http.HandlerFunc{
+		"GET /teams/42/members": func(w http.ResponseWriter, r *http.Request) {
+			calls++
+			replyPages(w, r, newUsers(first...), newUsers(second...))
+		},
+	})
+	votes := map[string]bool{"outsider": true, "member-101": false}
+	for i := 0; i < 102; i += 3 {
+		votes[fmt.Sprintf("member-%d", i)] = true
+	}
+	if err := filterVoters(client, "owner", "repo", votes); err != nil {
+		t.Fatalf("failed to filter voters: %v", err)
+	}
+	if calls != 2 {
+		t.Errorf("list call count mismatch: have %d, want %d", calls, 2)
+	}
+	if len(votes) != 35 {
+		t.Errorf("retained vote count mismatch: have %d, want %d", len(votes), 35)
+	}
+	if _, ok := votes["outsider"]; ok {
+		t.Errorf("outsider vote retained")
+	}
+	if _, ok := votes["member-99"]; !ok {
+		t.Errorf("first page member vote dropped")
+	}
+	if _, ok := votes["member-101"]; !ok {
+		t.Errorf("second page member vote dropped")
+	}
+}
+
+// Tests that the votes of users below the minimum role are advisory only, the
+// fine grained and custom roles being ranked by what they grant.
+func TestSplitAdvisory(t *testing.T) {
+	defer func(old string) { minimumRole = old }(minimumRole)
+	minimumRole = "maintain"
+
+	levels := map[string][2]string{
+		"writer":     {"write", "write"},
+		"maintainer": {"write", "maintain"},
+		"admin":      {"admin", "admin"},
+		"custom":     {"write", "security-reviewer"},
+	}
+	routes := make(map[string]http.HandlerFunc)
+	for user, level := range levels {
+		level := level
+		routes["GET /repos/owner/repo/collaborators/"+user+"/permission"] = func(w http.ResponseWriter, r *http.Request) {
+			reply(w, map[string]string{"permission": level[0], "role_name": level[1]})
+		}
+	}
+	client := newTestClient(t, routes)
+
+	votes := map[string]bool{"writer": true, "maintainer": true, "admin": false, "custom": true}
+	advisory, err := splitAdvisory(client, "owner", "repo", votes, make(map[string]string))
+	if err != nil {
+		t.Fatalf("failed to split advisory votes: %v", err)
+	}
+	if want := map[string]bool{"maintainer": true, "admin": false}; !reflect.DeepEqual(votes, want) {
+		t.Errorf("binding votes mismatch: have %v, want %v", votes, want)
+	}
+	if want := map[string]bool{"writer": true, "custom": true}; !reflect.DeepEqual(advisory, want) {
+		t.Errorf("advisory votes mismatch: have %v, want %v", advisory, want)
+	}
+}
+
+// Tests that a blocking downvote is cleared by the resolved emoji from its own
+// objector or from a maintainer, but not from anyone else.
+func TestResolvedEmoji(t *testing.T) {
+	defer func(old string) { resolvedEmoji = old }(resolvedEmoji)
+	resolvedEmoji = ":white_check_mark:"
+
+	routes := make(map[string]http.HandlerFunc)
+	for user, role := range map[string]string{"maintainer": "maintain", "bystander": "write", "objector": "write"} {
+		role := role
+		routes["GET /repos/owner/repo/collaborators/"+user+"/permission"] = func(w http.ResponseWriter, r *http.Request) {
+			reply(w, map[string]string{"permission": "write", "role_name": role})
+		}
+	}
+	client := newTestClient(t, routes)
+	tests := []struct {
+		comments []*github.IssueComment
+		votes    map[string]bool
+	}{
+		// Someone else can't clear the objection
+		{[]*github.IssueComment{
+			newComment(1, "objector", ":-1:", 0),
+			newComment(2, "bystander", ":white_check_mark:", time.Minute),
+		}, map[string]bool{"objector": false}},
+		// The objector can clear their own objection only
+		{[]*github.IssueComment{
+			newComment(1, "objector", ":-1:", 0),
+			newComment(2, "other", ":-1:", time.Minute),
+			newComment(3, "objector", "addressed :white_check_mark:", 2*time.Minute),
+		}, map[string]bool{"other": false}},
+		// A maintainer can clear all objections, keeping the upvotes
+		{[]*github.IssueComment{
+			newComment(1, "objector", ":-1:", 0),
+			newComment(2, "other", ":-1:", time.Minute),
+			newComment(3, "fan", ":+1:", 2*time.Minute),
+			newComment(4, "maintainer", ":white_check_mark:", 3*time.Minute),
+		}, map[string]bool{"fan": true}},
+	}
+	for i, tt := range tests {
+		maintainers, err := resolvers(client, "owner", "repo", tt.comments, make(map[string]string))
+		if err != nil {
+			t.Fatalf("test %d: failed to check resolvers: %v", i, err)
+		}
+		votes, _, _ := aggregate(tt.comments, nil, time.Time{}, maintainers, nil, nil)
+		if !reflect.DeepEqual(votes, tt.votes) {
+			t.Errorf("test %d: votes mismatch: have %v, want %v", i, votes, tt.votes)
+		}
+	}
+}
+
+// Tests that a vote mentioning a team counts for all its members, looking the
+// team up by its slug across all the organization's teams.
+func TestTeamMentionExpansion(t *testing.T) {
+	defer func(old bool) { expandTeams = old }(expandTeams)
+	expandTeams = true
+
+	var others []*github.Team
+	for i := 0; i < 100; i++ {
+		others = append(others, &github.Team{ID: github.Int(100 + i), Slug: github.String(fmt.Sprintf("team-%d", i))})
+	}
+	client := newTestClient(t, map[string]http.HandlerFunc{
+		"GET /orgs/org/teams": func(w http.ResponseWriter, r *http.Request) {
+			replyPages(w, r, others, []*github.Team{{ID: github.Int(7), Slug: github.String("reviewers")}})
+		},
+		"GET /teams/7/members": func(w http.ResponseWriter, r *http.Request) {
+			reply(w, newUsers("alice", "bob"))
+		},
+	})
+	comments := []*github.IssueComment{
+		newComment(1, "carol", ":+1: also on behalf of @org/reviewers", 0),
+		newComment(2, "dave", "cc @org/reviewers", time.Minute),
+	}
+	teams, err := teamMembers(client, comments, make(map[string][]string))
+	if err != nil {
+		t.Fatalf("failed to expand teams: %v", err)
+	}
+	votes, _, _ := aggregate(comments, nil, time.Time{}, nil, teams, nil)
+	if want := map[string]bool{"carol": true, "alice": true, "bob": true}; !reflect.DeepEqual(votes, want) {
+		t.Errorf("votes mismatch: have %v, want %v", votes, want)
+	}
+}
+
+// Tests that a team rule is enforced even if the matching files are beyond the
+// first page, and that an approval from any team member satisfies it.
+func TestTeamRuleApproval(t *testing.T) {
+	defer func(old []teamRule) { teamRules = old }(teamRules)
+	teamRules = []teamRule{{Pattern: "crypto/**", Team: "org/security"}}
+
+	var first []*github.CommitFile
+	for i := 0; i < 100; i++ {
+		first = append(first, &github.CommitFile{Filename: github.String(fmt.Sprintf("docs/page-%d.md", i))})
+	}
+	second := []*github.CommitFile{{Filename: github.String("crypto/keys.go")}}
+
+	client := newTestClient(t, map[string]http.HandlerFunc{
+		"GET /repos/owner/repo/pulls/343/files": func(w http.ResponseWriter, r *http.Request) {
+			replyPages(w, r, first, second)
+		},
+		"GET /orgs/org/teams": func(w http.ResponseWriter, r *http.Request) {
+			reply(w, []*github.Team{{ID: github.Int(9), Slug: github.String("security")}})
+		},
+		"GET /teams/9/members": func(w http.ResponseWriter, r *http.Request) {
+			reply(w, newUsers("alice", "bob"))
+		},
+	})
+	missing, err := missingApprovals(client, "owner", "repo", 343, map[string]bool{"carol": true, "bob": false}, make(map[string][]string))
+	if err != nil {
+		t.Fatalf("failed to check team approvals: %v", err)
+	}
+	if want := []string{"@org/security"}; !reflect.DeepEqual(missing, want) {
+		t.Errorf("missing approvals mismatch: have %v, want %v", missing, want)
+	}
+	missing, err = missingApprovals(client, "owner", "repo", 343, map[string]bool{"carol": true, "alice": true}, make(map[string][]string))
+	if err != nil {
+		t.Fatalf("failed to check team approvals: %v", err)
+	}
+	if len(missing) != 0 {
+		t.Errorf("security team approval not accepted: %v", missing)
+	}
+}
+
+// Tests that an upvote made together with a collaborator counts for both of them,
+// while naming a non-collaborator only counts the commenter.
+func TestCoApprovals(t *testing.T) {
+	defer func(old bool) { coApprovals = old }(coApprovals)
+	coApprovals = true
+
+	calls := 0
+	client := newTestClient(t, map[string]http.HandlerFunc{
+		"GET /repos/owner/repo/collaborators/alice": func(w http.ResponseWriter, r *http.Request) {
+			calls++
+			w.WriteHeader(http.StatusNoContent)
+		},
+		"GET /repos/owner/repo/collaborators/mallory": func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusNotFound)
+		},
+	})
+	comments := []*github.IssueComment{
+		newComment(1, "bob", ":+1: (with @alice)", 0),
+		newComment(2, "carol", ":+1: (with @mallory)", time.Minute),
+		newComment(3, "dave", ":+1: (with @alice) again", 2*time.Minute),
+	}
+	partners, err := coApprovers(client, "owner", "repo", comments)
+	if err != nil {
+		t.Fatalf("failed to check co-approvers: %v", err)
+	}
+	if calls != 1 {
+		t.Errorf("collaborator check count mismatch: have %d, want %d", calls, 1)
+	}
+	votes, _, _ := aggregate(comments[:1], nil, time.Time{}, nil, nil, partners)
+	if want := map[string]bool{"bob": true, "alice": true}; !reflect.DeepEqual(votes, want) {
+		t.Errorf("co-approved votes mismatch: have %v, want %v", votes, want)
+	}
+	votes, _, _ = aggregate(comments[1:2], nil, time.Time{}, nil, nil, partners)
+	if want := map[string]bool{"carol": true}; !reflect.DeepEqual(votes, want) {
+		t.Errorf("non-collaborator co-approval counted: have %v, want %v", votes, want)
+	}
+}
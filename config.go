@@ -0,0 +1,111 @@
+package robotally
+
+import (
+	"regexp"
+	"time"
+)
+
+// Configure the tallying behaviour
+var (
+	threshold = 2         // Number of net upvotes needed for a pull request to be approved
+	consensus = false     // Whether approval needs threshold upvotes and no downvotes at all
+	checkRuns = false     // Whether to publish the vote state as a check run on the PR head
+	tieVotes  = "neutral" // Outcome of an even up/down split, whatever the threshold: "pass", "fail" or "neutral"
+
+	reviewerRatio = 0.0 // Fraction of requested reviewers needing to upvote, instead of the threshold (0 = off)
+
+	requestChanges = false            // Whether to request changes on the PR while it has downvotes
+	readyOnly      = false            // Whether to ignore votes cast while the pull request was a draft
+	authorVotes    = true             // Whether the pull request author's own votes count
+	authorEmojis   = true             // Whether the pull request author's own reactions are reported
+	freshness      = time.Duration(0) // Age beyond which votes are shown as stale, not counted (0 = never)
+
+	requiredLabel = ""         // Label a pull request needs to be tallied (empty = tally all)
+	removeUngated = false      // Whether to delete the report when the required label is removed
+	optOutLabel   = "no-tally" // Label opting a pull request out of tallying (empty = none)
+
+	upvoteEmoji   = ":+1:" // Emoji counted as an upvote of the pull request
+	downvoteEmoji = ":-1:" // Emoji counted as a downvote of the pull request
+	voteMarker    = ""     // Line prefix votes need, e.g. "vote:", other emojis only react (empty = any line)
+	customEmoji   = false  // Whether to capture custom org emojis with uppercase shortcodes too
+
+	reactionTable = true  // Whether to report non-vote emoji reactions in a separate table
+	reactionRows  = 0     // Maximum number of distinct emojis in the reactions table (0 = all)
+	linkHeader    = false // Whether to link back to the pull request from the report
+	progressBar   = false // Whether to show the net votes toward the threshold as a progress bar
+	largeDiff     = 0     // Changed lines beyond which a pull request is warned about as large (0 = never)
+	linkedPRs     = false // Whether to combine the votes of PRs referenced from the body
+	inlineVotes   = false // Whether to report reactions on review comments as inline agreement
+	discussions   = false // Whether to report reactions on linked discussions as advisory votes
+	deferReport   = false // Whether to post the report only once the first vote arrives
+
+	createOnOpen   = true // Whether opening a pull request may create its report comment
+	createOnUpdate = true // Whether comments and labels may create a missing report comment
+
+	deleteOnClose = false            // Whether to delete the report comment when the PR is closed
+	lockOnClose   = false            // Whether to freeze the finalized report of a closed PR
+	staleReports  = time.Duration(0) // Age of reports re-rendered by the cron job (0 = never)
+	urgencyScore  = false            // Whether to score reactions by how soon after opening they came
+
+	testedEmoji    = ""    // Emoji marking that a user tested the PR (empty = no roster)
+	testedRequired = false // Whether at least one tester is needed before approval
+	resolvedEmoji  = ""    // Emoji clearing a blocking downvote (by its objector or a maintainer)
+
+	collaborators    = ""    // Voter filter strategy: "" (anyone), "each", "repo" or "team"
+	collaboratorTeam = 0     // Team (ID) whose members may vote with the "team" strategy
+	minimumRole      = ""    // Minimum role (write, maintain, admin) for binding votes
+	expandTeams      = false // Whether votes mentioning @org/team count for all members
+	coApprovals      = false // Whether "(with @user)" after an upvote counts for that collaborator too
+)
+
+// Pattern matching the authors of pull requests not to tally, e.g. dependency
+// update bots like `\[bot\]$` (nil = tally all authors).
+var botAuthors *regexp.Regexp
+
+// Fractional vote weights of emojis contributing to a soft score shown next to
+// the hard vote counts, e.g. 0.5 for :eyes: (empty = no soft score).
+var softWeights = map[string]float64{}
+
+// Reviewers to request a review from once a pull request is older than the
+// nudge age without them having voted.
+var (
+	nudgeReviewers = []string{}       // Logins of the reviewers to nudge (empty = none)
+	nudgeAfter     = time.Duration(0) // Age of a pull request to nudge the reviewers at (0 = never)
+)
+
+// Template of the single line footer closing each report, receiving the update
+// time as .Updated, e.g. to link to internal docs (empty = no footer).
+var footerTemplate = `Updated: {{.Updated.Format "Mon Jan 2 15:04:05 MST 2006"}}`
+
+// Authors of pull requests exempt from the protected branch warning, e.g. release
+// automation routinely targeting it (empty = warn for everyone).
+var warningExempt = map[string]bool{}
+
+// reactionGroup is a named set of emojis rendered together in the reactions
+// table, e.g. "Concerns" for :warning: and :x:.
+type reactionGroup struct {
+	Name   string
+	Emojis []string
+}
+
+// Groups to render the reactions under in order, the rest going into a default
+// section (empty = no grouping).
+var reactionGroups = []reactionGroup{}
+
+// teamRule requires an approval from a member of a team (org/team) for pull
+// requests touching files matching a path glob.
+type teamRule struct {
+	Pattern string
+	Team    string
+}
+
+// Teams that need to approve pull requests touching certain paths.
+var teamRules = []teamRule{}
+
+// Comment author associations (OWNER, MEMBER, COLLABORATOR, CONTRIBUTOR, ...)
+// whose votes are counted, e.g. to ignore fork contributors (empty = allow all).
+var voterAssociations = map[string]bool{}
+
+// Emojis to list first in the reactions table in the given order, regardless of
+// how many users reacted with them (empty = order by count only).
+var reactionPriority = []string{}
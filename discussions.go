@@ -0,0 +1,113 @@
+package robotally
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/google/go-github/github"
+)
+
+// discussionLink matches a link to a GitHub Discussion of the same repository
+// host, capturing the owner, repository and discussion number.
+var discussionLink = regexp.MustCompile(`https://github\.com/([A-Za-z0-9-]+)/([A-Za-z0-9_.-]+)/discussions/(\d+)`)
+
+// discussionQuery retrieves a page of the reactions on a discussion. Discussions
+// are only available via the GraphQL API, not the REST one.
+const discussionQuery = `query($owner: String!, $repo: String!, $number: Int!, $cursor: String) {
+	repository(owner: $owner, name: $repo) {
+		discussion(number: $number) {
+			reactions(first: 100, after: $cursor) {
+				pageInfo { hasNextPage endCursor }
+				nodes { content user { login } }
+			}
+		}
+	}
+}`
+
+// discussionReactions is the GraphQL response to the discussion query.
+type discussionReactions struct {
+	Data struct {
+		Repository struct {
+			Discussion *struct {
+				Reactions struct {
+					PageInfo struct {
+						HasNextPage bool   `json:"hasNextPage"`
+						EndCursor   string `json:"endCursor"`
+					} `json:"pageInfo"`
+					Nodes []struct {
+						Content string `json:"content"`
+						User    *struct {
+							Login string `json:"login"`
+						} `json:"user"`
+					} `json:"nodes"`
+				} `json:"reactions"`
+			} `json:"discussion"`
+		} `json:"repository"`
+	} `json:"data"`
+}
+
+// discussionAgreement gathers the thumbs up and down reactions on the GitHub
+// Discussions linked from the body of a PR, keyed by the vote emoji they map
+// to. These are advisory only and never affect the approval of the PR.
+func discussionAgreement(client *github.Client, body string) (map[string]map[string]struct{}, error) {
+	discussion := map[string]map[string]struct{}{
+		upvoteEmoji:   make(map[string]struct{}),
+		downvoteEmoji: make(map[string]struct{}),
+	}
+	seen := make(map[string]bool)
+	for _, match := range discussionLink.FindAllStringSubmatch(body, -1) {
+		if seen[match[0]] {
+			continue
+		}
+		seen[match[0]] = true
+
+		number, err := strconv.Atoi(match[3])
+		if err != nil {
+			continue
+		}
+		var cursor *string
+		for {
+			req, err := client.NewRequest("POST", graphqlEndpoint(client), map[string]interface{}{
+				"query":     discussionQuery,
+				"variables": map[string]interface{}{"owner": match[1], "repo": match[2], "number": number, "cursor": cursor},
+			})
+			if err != nil {
+				return nil, err
+			}
+			result := new(discussionReactions)
+			if _, err := client.Do(req, result); err != nil {
+				return nil, err
+			}
+			if result.Data.Repository.Discussion == nil {
+				break
+			}
+			reactions := result.Data.Repository.Discussion.Reactions
+			for _, reaction := range reactions.Nodes {
+				if reaction.User == nil || reaction.User.Login == githubUser {
+					continue
+				}
+				switch reaction.Content {
+				case "THUMBS_UP":
+					discussion[upvoteEmoji][reaction.User.Login] = struct{}{}
+				case "THUMBS_DOWN":
+					discussion[downvoteEmoji][reaction.User.Login] = struct{}{}
+				}
+			}
+			if !reactions.PageInfo.HasNextPage {
+				break
+			}
+			cursor = &reactions.PageInfo.EndCursor
+		}
+	}
+	return discussion, nil
+}
+
+// graphqlEndpoint resolves the GraphQL API endpoint of the client's host. It is
+// not below the REST API root on GitHub Enterprise (/api/graphql as opposed to
+// /api/v3), so it can't be requested relative to it.
+func graphqlEndpoint(client *github.Client) string {
+	endpoint := *client.BaseURL
+	endpoint.Path = strings.TrimSuffix(strings.TrimSuffix(endpoint.Path, "/"), "/v3") + "/graphql"
+	return endpoint.String()
+}
@@ -0,0 +1,103 @@
+package robotally
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/google/go-github/github"
+)
+
+// Tests that the reactions on a linked discussion are reported in their own
+// advisory section only, never counting toward the approval of the PR.
+func TestDiscussionReactionsAdvisory(t *testing.T) {
+	client := newTestClient(t, map[string]http.HandlerFunc{
+		"POST /graphql": func(w http.ResponseWriter, r *http.Request) {
+			query := new(struct {
+				Variables struct {
+					Cursor *string `json:"cursor"`
+				} `json:"variables"`
+			})
+			json.NewDecoder(r.Body).Decode(query)
+
+			// Serve the reactions in two pages, the second after the first's cursor
+			body := `{"data": {"repository": {"discussion": {"reactions": {
+				"pageInfo": {"hasNextPage": true, "endCursor": "page-2"},
+				"nodes": [
+					{"content": "THUMBS_UP", "user": {"login": "bob"}},
+					{"content": "HEART", "user": {"login": "dave"}}
+				]}}}}}`
+			if query.Variables.Cursor != nil {
+				if *query.Variables.Cursor != "page-2" {
+					t.Errorf("discussion cursor mismatch: have %s, want page-2", *query.Variables.Cursor)
+				}
+				body = `{"data": {"repository": {"discussion": {"reactions": {
+					"pageInfo": {"hasNextPage": false, "endCursor": "page-3"},
+					"nodes": [
+						{"content": "THUMBS_UP", "user": {"login": "carol"}}
+					]}}}}}`
+			}
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(body))
+		},
+	})
+	forum, err := discussionAgreement(client, "Implements https://github.com/owner/repo/discussions/383 as agreed")
+	if err != nil {
+		t.Fatalf("failed to gather discussion reactions: %v", err)
+	}
+	if want := map[string]map[string]struct{}{upvoteEmoji: {"bob": {}, "carol": {}}, downvoteEmoji: {}}; !reflect.DeepEqual(forum, want) {
+		t.Errorf("discussion reactions mismatch: have %v, want %v", forum, want)
+	}
+	votes := map[string]bool{"alice": true}
+
+	result, unmet := conclusion(&tally{Votes: votes, Forum: forum})
+	if want, wantUnmet := conclusion(&tally{Votes: votes}); result != want || !reflect.DeepEqual(unmet, wantUnmet) {
+		t.Errorf("discussion reactions affected the conclusion: have %s %v, want %s %v", result, unmet, want, wantUnmet)
+	}
+	report := status(markdown, &tally{Votes: votes, Forum: forum})
+	if !strings.Contains(report, "| :+1: | 1 | @alice |") {
+		t.Errorf("discussion reactions counted as votes:\n%s", report)
+	}
+	if !strings.Contains(report, "**Discussion reactions (advisory)**\n\n| Reaction | Count | Users |\n| :---: | :---: | :---: |\n| :+1: | 2 | @bob @carol |") {
+		t.Errorf("advisory discussion section missing:\n%s", report)
+	}
+}
+
+// Tests that a linked discussion nobody voted on renders no advisory section.
+func TestDiscussionWithoutReactions(t *testing.T) {
+	client := newTestClient(t, map[string]http.HandlerFunc{
+		"POST /graphql": func(w http.ResponseWriter, r *http.Request) {
+			reply(w, map[string]interface{}{"data": map[string]interface{}{"repository": map[string]interface{}{"discussion": map[string]interface{}{}}}})
+		},
+	})
+	forum, err := discussionAgreement(client, "See https://github.com/owner/repo/discussions/383")
+	if err != nil {
+		t.Fatalf("failed to gather discussion reactions: %v", err)
+	}
+	if report := status(markdown, &tally{Forum: forum}); strings.Contains(report, "Discussion reactions") {
+		t.Errorf("empty discussion reactions reported:\n%s", report)
+	}
+}
+
+// Tests that the GraphQL endpoint is resolved on both GitHub and its Enterprise
+// flavor, where it's not below the REST API root.
+func TestGraphqlEndpoint(t *testing.T) {
+	tests := []struct {
+		base     string
+		endpoint string
+	}{
+		{"https://api.github.com/", "https://api.github.com/graphql"},
+		{"https://github.example.com/api/v3/", "https://github.example.com/api/graphql"},
+	}
+	for i, tt := range tests {
+		client := github.NewClient(nil)
+		client.BaseURL, _ = url.Parse(tt.base)
+
+		if endpoint := graphqlEndpoint(client); endpoint != tt.endpoint {
+			t.Errorf("test %d: endpoint mismatch: have %s, want %s", i, endpoint, tt.endpoint)
+		}
+	}
+}
@@ -0,0 +1,100 @@
+package robotally
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/google/go-github/github"
+)
+
+// transientError is a processing failure expected to go away if the event is
+// redelivered, e.g. an API outage, rate limiting or a contended lock.
+type transientError struct {
+	err error
+}
+
+// Error implements the error interface.
+func (e *transientError) Error() string { return e.err.Error() }
+
+// permanentError is a processing failure that redelivering the event will not
+// fix, e.g. a deleted repository or missing permissions of the bot.
+type permanentError struct {
+	err error
+}
+
+// Error implements the error interface.
+func (e *permanentError) Error() string { return e.err.Error() }
+
+// validationError is a processing failure caused by the request itself asking
+// for something invalid.
+type validationError struct {
+	err error
+}
+
+// Error implements the error interface.
+func (e *validationError) Error() string { return e.err.Error() }
+
+// failed wraps the error of a processing step with the step's description,
+// keeping the classification of the original failure.
+func failed(step string, err error) error {
+	wrapped := fmt.Errorf("failed to %s: %v", step, err)
+	switch classify(err).(type) {
+	case *validationError:
+		return &validationError{wrapped}
+	case *permanentError:
+		return &permanentError{wrapped}
+	default:
+		return &transientError{wrapped}
+	}
+}
+
+// classify maps an error onto the processing failure types. API errors with a
+// client error status are permanent, apart from rate limiting (including the
+// secondary limits, reported as a 403 with a Retry-After header). All the others
+// (server errors, network, datastore and memcache failures) are transient.
+func classify(err error) error {
+	switch failure := err.(type) {
+	case *transientError, *permanentError, *validationError:
+		return err
+
+	case *github.ErrorResponse:
+		if failure.Response == nil || retriable(failure.Response.StatusCode) || rateLimited(failure.Response) {
+			return &transientError{err}
+		}
+		return &permanentError{err}
+
+	case *gitlabError:
+		if retriable(failure.Status) {
+			return &transientError{err}
+		}
+		return &permanentError{err}
+	}
+	return &transientError{err}
+}
+
+// retriable reports whether an API response status is worth retrying on.
+func retriable(status int) bool {
+	return status < http.StatusBadRequest || status >= http.StatusInternalServerError || status == http.StatusTooManyRequests
+}
+
+// rateLimited reports whether a GitHub API response was refused due to either
+// the primary or one of the secondary rate limits.
+func rateLimited(res *http.Response) bool {
+	if res.Header.Get("X-RateLimit-Remaining") == "0" {
+		return true
+	}
+	return res.StatusCode == http.StatusForbidden && res.Header.Get("Retry-After") != ""
+}
+
+// errorStatus maps a processing failure onto the HTTP status to respond with,
+// so webhook senders only redeliver events that might succeed on a retry.
+func errorStatus(err error) int {
+	switch classify(err).(type) {
+	case *validationError:
+		return http.StatusBadRequest
+	case *permanentError:
+		return http.StatusUnprocessableEntity
+	default:
+		return http.StatusServiceUnavailable
+	}
+}
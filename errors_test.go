@@ -0,0 +1,52 @@
+package robotally
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+
+	"github.com/google/go-github/github"
+)
+
+// Tests that each processing failure type is answered with the status telling
+// webhook senders whether to redeliver the event.
+func TestErrorStatus(t *testing.T) {
+	apiError := func(status int, headers map[string]string) error {
+		res := newResponse(status, "")
+		res.Request, _ = http.NewRequest("GET", "https://api.github.com/repos/owner/repo", nil)
+		for key, value := range headers {
+			res.Header.Set(key, value)
+		}
+		return &github.ErrorResponse{Response: res, Message: http.StatusText(status)}
+	}
+	tests := []struct {
+		err    error
+		status int
+	}{
+		{&validationError{errors.New("invalid")}, http.StatusBadRequest},
+		{&permanentError{errors.New("gone")}, http.StatusUnprocessableEntity},
+		{&transientError{errors.New("outage")}, http.StatusServiceUnavailable},
+		{errors.New("datastore timeout"), http.StatusServiceUnavailable},
+
+		{apiError(http.StatusNotFound, nil), http.StatusUnprocessableEntity},
+		{apiError(http.StatusForbidden, nil), http.StatusUnprocessableEntity},
+		{apiError(http.StatusForbidden, map[string]string{"X-RateLimit-Remaining": "0"}), http.StatusServiceUnavailable},
+		{apiError(http.StatusForbidden, map[string]string{"Retry-After": "60", "X-RateLimit-Remaining": "4321"}), http.StatusServiceUnavailable},
+		{apiError(http.StatusTooManyRequests, nil), http.StatusServiceUnavailable},
+		{apiError(http.StatusBadGateway, nil), http.StatusServiceUnavailable},
+		{&github.ErrorResponse{Message: "no response"}, http.StatusServiceUnavailable},
+
+		{&gitlabError{Method: "GET", Path: "projects/1", Status: http.StatusNotFound}, http.StatusUnprocessableEntity},
+		{&gitlabError{Method: "GET", Path: "projects/1", Status: http.StatusTooManyRequests}, http.StatusServiceUnavailable},
+		{&gitlabError{Method: "GET", Path: "projects/1", Status: http.StatusInternalServerError}, http.StatusServiceUnavailable},
+
+		{failed("fetch comments", apiError(http.StatusNotFound, nil)), http.StatusUnprocessableEntity},
+		{failed("fetch comments", apiError(http.StatusForbidden, map[string]string{"Retry-After": "60"})), http.StatusServiceUnavailable},
+		{failed("parse event", &validationError{errors.New("invalid")}), http.StatusBadRequest},
+	}
+	for i, tt := range tests {
+		if status := errorStatus(tt.err); status != tt.status {
+			t.Errorf("test %d: status mismatch for %v: have %d, want %d", i, tt.err, status, tt.status)
+		}
+	}
+}
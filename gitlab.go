@@ -0,0 +1,320 @@
+package robotally
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/google/go-github/github"
+	"golang.org/x/net/context"
+	"golang.org/x/oauth2"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/log"
+)
+
+// gitlabEvent is the GitLab webhook notification of a merge request or note
+// action. The object attributes are the merge request itself for merge request
+// events, or the note for note events (the merge request being separate then).
+type gitlabEvent struct {
+	ObjectKind       string         `json:"object_kind"`
+	User             *gitlabAccount `json:"user"`
+	Project          *gitlabProject `json:"project"`
+	ObjectAttributes *gitlabObject  `json:"object_attributes"`
+	MergeRequest     *gitlabObject  `json:"merge_request"`
+}
+
+// gitlabAccount represents a GitLab user.
+type gitlabAccount struct {
+	Username string `json:"username"`
+}
+
+// gitlabProject represents the project originating a webhook event.
+type gitlabProject struct {
+	ID                int    `json:"id"`
+	PathWithNamespace string `json:"path_with_namespace"`
+}
+
+// gitlabObject represents the merge request or note being reported on.
+type gitlabObject struct {
+	IID          int           `json:"iid"`
+	URL          string        `json:"url"`
+	Action       string        `json:"action"`
+	TargetBranch string        `json:"target_branch"`
+	LastCommit   *gitlabCommit `json:"last_commit"`
+	NoteableType string        `json:"noteable_type"`
+}
+
+// gitlabCommit represents the head commit of a merge request.
+type gitlabCommit struct {
+	ID string `json:"id"`
+}
+
+// gitlabNote represents a comment on a merge request.
+type gitlabNote struct {
+	ID        int           `json:"id"`
+	Body      string        `json:"body"`
+	Author    gitlabAccount `json:"author"`
+	System    bool          `json:"system"`
+	CreatedAt time.Time     `json:"created_at"`
+}
+
+// gitlabHandler processes the GitLab webhook events, tallying the votes of merge
+// requests the same way as GitHub pull requests. Events not carrying the secret
+// token are rejected, as are all of them if no secret is configured.
+func gitlabHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := appengine.NewContext(r)
+
+	if gitlabSecret == "" || !hmac.Equal([]byte(r.Header.Get("X-Gitlab-Token")), []byte(gitlabSecret)) {
+		http.Error(w, "Unauthorized request", http.StatusUnauthorized)
+		return
+	}
+	// Decode any GitLab event, and check for outside supported actions exclusively
+	e := new(gitlabEvent)
+	if err := json.NewDecoder(r.Body).Decode(e); err != nil {
+		http.Error(w, "Invalid GitLab event", http.StatusBadRequest)
+		return
+	}
+	if e.User != nil && e.User.Username == gitlabUser {
+		return
+	}
+	if e.Project == nil || e.ObjectAttributes == nil {
+		http.Error(w, "Unsupported method", http.StatusMethodNotAllowed)
+		return
+	}
+	if len(allowedProjects) > 0 && !allowedProjects[e.Project.PathWithNamespace] {
+		log.Infof(ctx, "Ignoring event from non-allowlisted project: %s", e.Project.PathWithNamespace)
+		return
+	}
+	client := newGitlabClient(ctx)
+
+	// Handle the event, depending whether creation or note
+	switch {
+	case e.ObjectKind == "merge_request" && e.ObjectAttributes.Action == "open":
+		if _, err := gitlabRefresh(ctx, client, e.Project, e.ObjectAttributes, createOnOpen); err != nil {
+			http.Error(w, fmt.Sprintf("Failed to create report: %v", err), errorStatus(err))
+		}
+
+	case e.ObjectKind == "note" && e.ObjectAttributes.NoteableType == "MergeRequest" && e.MergeRequest != nil:
+		if _, err := gitlabRefresh(ctx, client, e.Project, e.MergeRequest, createOnUpdate); err != nil {
+			http.Error(w, fmt.Sprintf("Failed to refresh report: %v", err), errorStatus(err))
+		}
+	}
+}
+
+// gitlabRefresh gathers all the notes of a merge request, aggregates the votes
+// and reactions from them and updates the status report with the fresh tally.
+// If no report exists yet, a new one is only posted if create is set. Refreshes
+// of the same merge request are serialized like those of pull requests.
+//
+// The notes are mapped onto GitHub comments to share the aggregation, but only
+// the plain votes and reactions are tallied, the GitHub specific features (e.g.
+// reviews or team approvals) are not available.
+func gitlabRefresh(ctx context.Context, client *gitlabClient, project *gitlabProject, mr *gitlabObject, create bool) (*outcome, error) {
+	repo := "gitlab:" + project.PathWithNamespace
+
+	unlock, err := lock(ctx, repo, mr.IID)
+	if err != nil {
+		return nil, failed("lock merge request", err)
+	}
+	defer unlock()
+
+	out := &outcome{Action: "skipped"}
+	record, err := loadRecord(ctx, repo, mr.IID)
+	if err != nil {
+		return nil, failed("load tally record", err)
+	}
+	if record.Disabled {
+		return out, nil
+	}
+	notes, err := client.notes(project.ID, mr.IID)
+	if err != nil {
+		return nil, failed("list notes", err)
+	}
+	// Map the human notes onto comments, finding the previous report along the way
+	var (
+		previous *gitlabNote
+		comments []*github.IssueComment
+	)
+	for i, note := range notes {
+		if note.System {
+			continue
+		}
+		if note.Author.Username == gitlabUser {
+			if note.ID == record.CommentID || (previous == nil && strings.Contains(note.Body, summaryMarker)) {
+				previous = &notes[i]
+			}
+			continue
+		}
+		comments = append(comments, &github.IssueComment{
+			ID:        github.Int(note.ID),
+			Body:      github.String(note.Body),
+			User:      &github.User{Login: github.String(note.Author.Username)},
+			CreatedAt: &notes[i].CreatedAt,
+		})
+	}
+	chronological(comments)
+
+	if previous == nil && !create {
+		return out, nil
+	}
+	votes, stale, reactions := aggregate(comments, nil, time.Time{}, nil, nil, nil)
+	if previous == nil && deferReport && len(votes) == 0 {
+		return out, nil
+	}
+	muted, err := mutedUsers(ctx)
+	if err != nil {
+		return nil, failed("load notification preferences", err)
+	}
+	sha := ""
+	if mr.LastCommit != nil {
+		sha = mr.LastCommit.ID
+	}
+	report := status(markdown, &tally{
+		Link:      mr.URL,
+		Warnings:  prWarnings(mr.TargetBranch, "", 0),
+		Commit:    sha,
+		Votes:     votes,
+		Stale:     stale,
+		Reactions: reactions,
+		Soft:      softScore(reactions),
+		Muted:     muted,
+	})
+	for _, yes := range votes {
+		if yes {
+			out.Up++
+		} else {
+			out.Down++
+		}
+	}
+	// Skip the edit if only the timestamp would change, avoiding notification churn
+	if previous != nil && substance(previous.Body) == substance(report) {
+		out.Action, out.CommentID = "unchanged", previous.ID
+		return out, nil
+	}
+	id := 0
+	if previous != nil {
+		err = client.editNote(project.ID, mr.IID, previous.ID, report)
+		if err == nil {
+			id = previous.ID
+		} else if gitlabNotFound(err) {
+			log.Warningf(ctx, "Report note %d of %s!%d vanished, posting anew", previous.ID, project.PathWithNamespace, mr.IID)
+		} else {
+			return nil, failed("update merge request report", err)
+		}
+	}
+	if id == 0 {
+		note, err := client.createNote(project.ID, mr.IID, report)
+		if err != nil {
+			return nil, failed("comment on merge request", err)
+		}
+		id = note.ID
+	}
+	if err := saveRecord(ctx, repo, mr.IID, id, sha, report); err != nil {
+		return nil, failed("store tally record", err)
+	}
+	out.Action, out.CommentID = "updated", id
+	return out, nil
+}
+
+// gitlabClient is a minimal client of the GitLab v4 API, covering the notes of
+// merge requests only.
+type gitlabClient struct {
+	client *http.Client
+}
+
+// gitlabError is the failure of a GitLab API call with a non-success status.
+type gitlabError struct {
+	Method string
+	Path   string
+	Status int
+}
+
+// Error implements the error interface.
+func (e *gitlabError) Error() string {
+	return fmt.Sprintf("%s %s: %d %s", e.Method, e.Path, e.Status, http.StatusText(e.Status))
+}
+
+// gitlabNotFound reports whether a GitLab API error is a 404 Not Found.
+func gitlabNotFound(err error) bool {
+	failure, ok := err.(*gitlabError)
+	return ok && failure.Status == http.StatusNotFound
+}
+
+// newGitlabClient creates a GitLab API client authenticated with the bot's token,
+// throttled the same way as the GitHub one.
+func newGitlabClient(ctx context.Context) *gitlabClient {
+	auth := oauth2.NewClient(ctx, oauth2.StaticTokenSource(
+		&oauth2.Token{AccessToken: gitlabToken},
+	))
+	auth.Transport = &throttledTransport{base: auth.Transport, throttle: throttleOf(gitlabToken)}
+	return &gitlabClient{client: auth}
+}
+
+// do executes a GitLab API call, encoding the request body and decoding the
+// response into result if not nil. The response is returned for pagination.
+func (c *gitlabClient) do(method, path string, body interface{}, result interface{}) (*http.Response, error) {
+	var payload bytes.Buffer
+	if body != nil {
+		if err := json.NewEncoder(&payload).Encode(body); err != nil {
+			return nil, err
+		}
+	}
+	req, err := http.NewRequest(method, gitlabURL+"/api/v4"+path, &payload)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	res, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		return nil, &gitlabError{Method: method, Path: path, Status: res.StatusCode}
+	}
+	if result != nil {
+		if err := json.NewDecoder(res.Body).Decode(result); err != nil {
+			return nil, err
+		}
+	}
+	return res, nil
+}
+
+// notes retrieves all the notes of a merge request, oldest first.
+func (c *gitlabClient) notes(project, iid int) ([]gitlabNote, error) {
+	var notes []gitlabNote
+	for page := "1"; page != ""; {
+		var batch []gitlabNote
+
+		query := url.Values{"sort": {"asc"}, "order_by": {"created_at"}, "per_page": {"100"}, "page": {page}}
+		res, err := c.do("GET", fmt.Sprintf("/projects/%d/merge_requests/%d/notes?%s", project, iid, query.Encode()), nil, &batch)
+		if err != nil {
+			return nil, err
+		}
+		notes = append(notes, batch...)
+		page = res.Header.Get("X-Next-Page")
+	}
+	return notes, nil
+}
+
+// createNote posts a new note on a merge request.
+func (c *gitlabClient) createNote(project, iid int, body string) (*gitlabNote, error) {
+	note := new(gitlabNote)
+	if _, err := c.do("POST", fmt.Sprintf("/projects/%d/merge_requests/%d/notes", project, iid), map[string]string{"body": body}, note); err != nil {
+		return nil, err
+	}
+	return note, nil
+}
+
+// editNote replaces the body of an existing note on a merge request.
+func (c *gitlabClient) editNote(project, iid, id int, body string) error {
+	_, err := c.do("PUT", fmt.Sprintf("/projects/%d/merge_requests/%d/notes/%d", project, iid, id), map[string]string{"body": body}, nil)
+	return err
+}
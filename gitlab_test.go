@@ -0,0 +1,167 @@
+package robotally
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// gitlabNoteEvent is a note webhook notification as sent by GitLab, commenting
+// on the merge request !367 of the group/project project.
+const gitlabNoteEvent = `{
+	"object_kind": "note",
+	"event_type": "note",
+	"user": {"id": 1, "name": "Alice", "username": "alice"},
+	"project_id": 5,
+	"project": {"id": 5, "name": "project", "path_with_namespace": "group/project"},
+	"object_attributes": {
+		"id": 1244,
+		"note": ":+1:",
+		"noteable_type": "MergeRequest",
+		"url": "https://gitlab.com/group/project/-/merge_requests/367#note_1244"
+	},
+	"merge_request": {
+		"id": 7,
+		"iid": 367,
+		"target_branch": "master",
+		"url": "https://gitlab.com/group/project/-/merge_requests/367",
+		"last_commit": {"id": "0123456789abcdef"}
+	}
+}`
+
+// deliverGitlab sends a GitLab webhook notification with the given secret token
+// to the global handler.
+func deliverGitlab(t *testing.T, body string, token string) *httptest.ResponseRecorder {
+	req := newRequest(t, "POST", "/", strings.NewReader(body))
+	req.Header.Set("X-Gitlab-Event", "Note Hook")
+	req.Header.Set("X-Gitlab-Token", token)
+
+	rec := httptest.NewRecorder()
+	handler(rec, req)
+	return rec
+}
+
+// Tests that a GitLab note webhook is decoded into its merge request and tallied,
+// but only from authenticated and allowlisted projects.
+func TestGitlabNoteEvent(t *testing.T) {
+	defer func(url, token, secret string, projects map[string]bool) {
+		gitlabURL, gitlabToken, gitlabSecret, allowedProjects = url, token, secret, projects
+	}(gitlabURL, gitlabToken, gitlabSecret, allowedProjects)
+	gitlabToken, allowedProjects = "token", map[string]bool{"group/project": true}
+
+	var created []string
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method + " " + r.URL.Path {
+		case "GET /api/v4/projects/5/merge_requests/367/notes":
+			reply(w, []gitlabNote{
+				{ID: 1, Body: "Looks good :+1:", Author: gitlabAccount{Username: "alice"}, CreatedAt: testTime},
+				{ID: 2, Body: "added 1 commit", Author: gitlabAccount{Username: "bob"}, System: true, CreatedAt: testTime.Add(time.Minute)},
+			})
+		case "POST /api/v4/projects/5/merge_requests/367/notes":
+			note := new(struct {
+				Body string `json:"body"`
+			})
+			json.NewDecoder(r.Body).Decode(note)
+			created = append(created, note.Body)
+			reply(w, &gitlabNote{ID: 3, Body: note.Body})
+		default:
+			t.Errorf("unexpected GitLab API call: %s %s", r.Method, r.URL.Path)
+			http.NotFound(w, r)
+		}
+	}))
+	defer api.Close()
+	gitlabURL = api.URL
+
+	// Without a secret configured, or with a wrong one sent, nothing may happen
+	if rec := deliverGitlab(t, gitlabNoteEvent, ""); rec.Code != http.StatusUnauthorized {
+		t.Errorf("event accepted without a configured secret: %d", rec.Code)
+	}
+	gitlabSecret = "secret"
+	if rec := deliverGitlab(t, gitlabNoteEvent, "wrong"); rec.Code != http.StatusUnauthorized {
+		t.Errorf("event accepted with a wrong secret: %d", rec.Code)
+	}
+	// GitHub repositories in the allowlist must not let GitLab projects in
+	allowedProjects = map[string]bool{"owner/repo": true}
+	if rec := deliverGitlab(t, gitlabNoteEvent, "secret"); rec.Code != http.StatusOK || len(created) != 0 {
+		t.Errorf("non-allowlisted project tallied: %d, %v", rec.Code, created)
+	}
+	allowedProjects = map[string]bool{"group/project": true}
+
+	rec := deliverGitlab(t, gitlabNoteEvent, "secret")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("note processing failed: %d %s", rec.Code, rec.Body)
+	}
+	if len(created) != 1 {
+		t.Fatalf("report note count mismatch: have %d, want %d", len(created), 1)
+	}
+	for _, want := range []string{"| :+1: | 1 | @alice |", "| :-1: | 0 |  |", "Pull request against `master`", "_Tally at commit 0123456_"} {
+		if !strings.Contains(created[0], want) {
+			t.Errorf("report missing %q:\n%s", want, created[0])
+		}
+	}
+	record, err := loadRecord(newContext(t), "gitlab:group/project", 367)
+	if err != nil {
+		t.Fatalf("failed to load record: %v", err)
+	}
+	if record.CommentID != 3 {
+		t.Errorf("stored note mismatch: have %d, want %d", record.CommentID, 3)
+	}
+}
+
+// Tests that GitLab events are not handled at all unless GitLab is configured,
+// being treated as GitHub ones instead.
+func TestGitlabDisabled(t *testing.T) {
+	defer func(token, secret string) { gitlabToken, gitlabSecret = token, secret }(gitlabToken, gitlabSecret)
+	gitlabToken, gitlabSecret = "", "secret"
+
+	defer func(old map[string][]byte) { githubSecrets = old }(githubSecrets)
+	githubSecrets = map[string][]byte{"owner/repo": []byte("github")}
+
+	if rec := deliverGitlab(t, gitlabNoteEvent, "secret"); rec.Code != http.StatusUnauthorized {
+		t.Errorf("GitLab event bypassed the GitHub signature check: %d", rec.Code)
+	}
+}
+
+// Tests that GitLab merge requests honor the edit only mode too, neither opening
+// one nor noting on it creating a report.
+func TestGitlabEditOnlyMode(t *testing.T) {
+	defer func(url, token, secret string) { gitlabURL, gitlabToken, gitlabSecret = url, token, secret }(gitlabURL, gitlabToken, gitlabSecret)
+	gitlabToken, gitlabSecret = "token", "secret"
+
+	defer func(open, update bool) { createOnOpen, createOnUpdate = open, update }(createOnOpen, createOnUpdate)
+	createOnOpen, createOnUpdate = false, false
+
+	created := 0
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method + " " + r.URL.Path {
+		case "GET /api/v4/projects/5/merge_requests/367/notes":
+			reply(w, []gitlabNote{{ID: 1, Body: ":+1:", Author: gitlabAccount{Username: "alice"}, CreatedAt: testTime}})
+		case "POST /api/v4/projects/5/merge_requests/367/notes":
+			created++
+			reply(w, &gitlabNote{ID: 2})
+		default:
+			t.Errorf("unexpected GitLab API call: %s %s", r.Method, r.URL.Path)
+			http.NotFound(w, r)
+		}
+	}))
+	defer api.Close()
+	gitlabURL = api.URL
+
+	opened := `{
+		"object_kind": "merge_request",
+		"user": {"username": "author"},
+		"project": {"id": 5, "path_with_namespace": "group/project"},
+		"object_attributes": {"iid": 367, "action": "open", "target_branch": "dev"}
+	}`
+	for _, event := range []string{opened, gitlabNoteEvent} {
+		if rec := deliverGitlab(t, event, "secret"); rec.Code != http.StatusOK {
+			t.Fatalf("event processing failed: %d %s", rec.Code, rec.Body)
+		}
+	}
+	if created != 0 {
+		t.Errorf("report created in edit only mode: %d notes", created)
+	}
+}
@@ -0,0 +1,74 @@
+package robotally
+
+import (
+	"bytes"
+	"crypto/rand"
+	"fmt"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/memcache"
+)
+
+// Timings of the per pull request locks serializing report updates. The expiry
+// ensures a crashed request doesn't block its PR forever, so it needs to stay
+// well above the time a single refresh takes, rate limit back-offs included.
+const (
+	lockExpiry  = 30 * time.Second       // Time after which an unreleased lock is dropped
+	lockTimeout = 20 * time.Second       // Time to wait for a lock before giving up
+	lockRetry   = 100 * time.Millisecond // Time to wait between attempts to acquire a lock
+)
+
+// lock acquires a memcache based mutex on a pull request, so that concurrent
+// events can't interleave their read-aggregate-edit sequences and lose updates.
+// The lock is held with a unique token, so that a request outliving the expiry
+// can't release the lock someone else took since. A released lock is kept as
+// an empty item, taken over through compare-and-swap. The returned function
+// releases the lock.
+func lock(ctx context.Context, repo string, number int) (func(), error) {
+	key := fmt.Sprintf("lock/%s/%d", repo, number)
+
+	token := make([]byte, 16)
+	if _, err := rand.Read(token); err != nil {
+		return nil, err
+	}
+	deadline := time.Now().Add(lockTimeout)
+	for {
+		// Try to create the lock, or take it over if released
+		err := memcache.Add(ctx, &memcache.Item{Key: key, Value: token, Expiration: lockExpiry})
+		if err == memcache.ErrNotStored {
+			var item *memcache.Item
+			if item, err = memcache.Get(ctx, key); err == nil {
+				if len(item.Value) == 0 {
+					item.Value, item.Expiration = token, lockExpiry
+					err = memcache.CompareAndSwap(ctx, item)
+				} else {
+					err = memcache.ErrNotStored
+				}
+			}
+		}
+		switch err {
+		case nil:
+			return func() { unlock(ctx, key, token) }, nil
+		case memcache.ErrNotStored, memcache.ErrCASConflict, memcache.ErrCacheMiss:
+			// Lock held, or changed hands while checking, try again
+		default:
+			return nil, err
+		}
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf("timed out waiting for %s#%d", repo, number)
+		}
+		time.Sleep(lockRetry)
+	}
+}
+
+// unlock releases a lock if it is still held with the given token, leaving it
+// alone if it expired and was since acquired by someone else.
+func unlock(ctx context.Context, key string, token []byte) {
+	item, err := memcache.Get(ctx, key)
+	if err != nil || !bytes.Equal(item.Value, token) {
+		return
+	}
+	item.Value, item.Expiration = []byte{}, lockExpiry
+	memcache.CompareAndSwap(ctx, item)
+}
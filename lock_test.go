@@ -0,0 +1,118 @@
+package robotally
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/go-github/github"
+	"google.golang.org/appengine/memcache"
+)
+
+// Tests that a lock is exclusive until released, and that a holder whose lock
+// expired can't release it from under the one who took it since.
+func TestLockOwnership(t *testing.T) {
+	ctx := newContext(t)
+
+	unlockFirst, err := lock(ctx, "owner/repo", 369)
+	if err != nil {
+		t.Fatalf("failed to acquire lock: %v", err)
+	}
+	// Simulate the first lock expiring, and someone else taking it
+	if err := memcache.Delete(ctx, "lock/owner/repo/369"); err != nil {
+		t.Fatalf("failed to expire lock: %v", err)
+	}
+	unlockSecond, err := lock(ctx, "owner/repo", 369)
+	if err != nil {
+		t.Fatalf("failed to acquire expired lock: %v", err)
+	}
+	unlockFirst()
+
+	acquired := make(chan func())
+	go func() {
+		unlock, err := lock(ctx, "owner/repo", 369)
+		if err != nil {
+			t.Errorf("failed to acquire released lock: %v", err)
+		}
+		acquired <- unlock
+	}()
+	select {
+	case <-acquired:
+		t.Fatalf("lock released by a previous holder")
+	case <-time.After(3 * lockRetry):
+	}
+	unlockSecond()
+
+	select {
+	case unlock := <-acquired:
+		unlock()
+	case <-time.After(10 * lockRetry):
+		t.Fatalf("released lock not acquired")
+	}
+}
+
+// Tests that two concurrent events on the same pull request are serialized, the
+// final report reflecting the votes seen by both.
+func TestConcurrentRefresh(t *testing.T) {
+	pr := &fakePR{Number: 3690, Author: "author", Comments: []*github.IssueComment{
+		newComment(1, githubUser, summaryMarker+"\n\nstale report", 0),
+		newComment(2, "alice", ":+1:", time.Minute),
+	}}
+	routes := pr.install(make(map[string]http.HandlerFunc))
+
+	// Hold back the report edit missing the second vote until the other refresh
+	// edited it, which can only happen first if the refreshes aren't serialized
+	var (
+		listed = make(chan struct{})
+		edited = make(chan struct{})
+		once   sync.Once
+	)
+	list, edit := routes["GET /repos/owner/repo/issues/3690/comments"], routes["PATCH /repos/owner/repo/issues/comments/1"]
+	routes["GET /repos/owner/repo/issues/3690/comments"] = func(w http.ResponseWriter, r *http.Request) {
+		list(w, r)
+		once.Do(func() { close(listed) })
+	}
+	routes["PATCH /repos/owner/repo/issues/comments/1"] = func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+		if complete := strings.Contains(string(body), "@bob"); !complete {
+			select {
+			case <-edited:
+			case <-time.After(time.Second):
+			}
+			edit(w, r)
+		} else {
+			edit(w, r)
+			close(edited)
+		}
+	}
+	client := newTestClient(t, routes)
+
+	ctx := newContext(t)
+	var pending sync.WaitGroup
+	refreshed := func() {
+		defer pending.Done()
+		if _, err := refresh(ctx, client, "owner", "repo", 3690, false, false); err != nil {
+			t.Errorf("failed to refresh: %v", err)
+		}
+	}
+	pending.Add(2)
+	go refreshed()
+	<-listed
+
+	pr.lock.Lock()
+	pr.Comments = append(pr.Comments, newComment(3, "bob", ":+1:", 2*time.Minute))
+	pr.lock.Unlock()
+
+	go refreshed()
+	pending.Wait()
+
+	if !strings.Contains(pr.Edited[1], "| :+1: | 2 | @alice @bob |") {
+		t.Errorf("concurrent vote lost:\n%s", pr.Edited[1])
+	}
+}
@@ -0,0 +1,91 @@
+package robotally
+
+import (
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+// format is the markup flavor a status report is rendered in.
+type format int
+
+const (
+	markdown format = iota // GitHub flavored Markdown, used for comments
+	plain                  // Plain text with ASCII tables, e.g. for email digests
+)
+
+// emphasis renders a piece of side note text, italic in Markdown.
+func (f format) emphasis(text string) string {
+	if f == markdown {
+		return "_" + text + "_"
+	}
+	return text
+}
+
+// strong renders a piece of heading text, bold in Markdown.
+func (f format) strong(text string) string {
+	if f == markdown {
+		return "**" + text + "**"
+	}
+	return text
+}
+
+// warning renders an attention grabbing warning line.
+func (f format) warning(text string) string {
+	if f == markdown {
+		return ":exclamation: " + text + " :exclamation:"
+	}
+	return "!!! " + text + " !!!"
+}
+
+// progress renders a bar of done out of total steps, using colored squares in
+// Markdown and ASCII art in plain text.
+func (f format) progress(done, total int) string {
+	if done < 0 {
+		done = 0
+	}
+	if done > total {
+		done = total
+	}
+	if f == markdown {
+		return strings.Repeat("🟩", done) + strings.Repeat("⬜", total-done) + fmt.Sprintf(" %d/%d", done, total)
+	}
+	return "[" + strings.Repeat("#", done) + strings.Repeat("-", total-done) + fmt.Sprintf("] %d/%d", done, total)
+}
+
+// table renders a table with the given header and rows, centered in Markdown
+// and as a boxed ASCII table in plain text.
+func (f format) table(header []string, rows [][]string) string {
+	if f == markdown {
+		lines := []string{"| " + strings.Join(header, " | ") + " |", "|" + strings.Repeat(" :---: |", len(header))}
+		for _, row := range rows {
+			lines = append(lines, "| "+strings.Join(row, " | ")+" |")
+		}
+		return strings.Join(lines, "\n")
+	}
+	// Plain text table, calculate the column widths first
+	widths := make([]int, len(header))
+	for _, row := range append([][]string{header}, rows...) {
+		for i, cell := range row {
+			if n := utf8.RuneCountInString(cell); n > widths[i] {
+				widths[i] = n
+			}
+		}
+	}
+	border := "+"
+	for _, width := range widths {
+		border += strings.Repeat("-", width+2) + "+"
+	}
+	line := func(row []string) string {
+		text := "|"
+		for i, cell := range row {
+			text += " " + cell + strings.Repeat(" ", widths[i]-utf8.RuneCountInString(cell)) + " |"
+		}
+		return text
+	}
+	lines := []string{border, line(header), border}
+	for _, row := range rows {
+		lines = append(lines, line(row))
+	}
+	return strings.Join(append(lines, border), "\n")
+}
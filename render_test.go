@@ -0,0 +1,164 @@
+package robotally
+
+import (
+	"strings"
+	"testing"
+	"text/template"
+	"time"
+)
+
+// Tests that the same tally renders to both Markdown and plain text, the latter
+// without any Markdown markup.
+func TestRenderFormats(t *testing.T) {
+	state := &tally{
+		Warnings: []string{"Targets a protected branch"},
+		Commit:   "0123456789abcdef",
+		Votes:    map[string]bool{"alice": true, "bob": true, "carol": false},
+	}
+	md := status(markdown, state)
+	for _, want := range []string{
+		summaryMarker,
+		":exclamation: Targets a protected branch :exclamation:",
+		"_Review state: contested_",
+		"| Vote | Count | Reviewers |\n| :---: | :---: | :---: |\n| :+1: | 2 | @alice @bob |\n| :-1: | 1 | @carol |",
+		"_Tally at commit 0123456_",
+	} {
+		if !strings.Contains(md, want) {
+			t.Errorf("markdown report missing %q:\n%s", want, md)
+		}
+	}
+	txt := status(plain, state)
+	for _, want := range []string{
+		"!!! Targets a protected branch !!!",
+		"\nReview state: contested\n",
+		"+------+-------+-------------+\n" +
+			"| Vote | Count | Reviewers   |\n" +
+			"+------+-------+-------------+\n" +
+			"| :+1: | 2     | @alice @bob |\n" +
+			"| :-1: | 1     | @carol      |\n" +
+			"+------+-------+-------------+",
+		"\nTally at commit 0123456",
+	} {
+		if !strings.Contains(txt, want) {
+			t.Errorf("plain report missing %q:\n%s", want, txt)
+		}
+	}
+	for _, markup := range []string{"<!--", ":---:", "_Review", "**", ":exclamation:"} {
+		if strings.Contains(txt, markup) {
+			t.Errorf("plain report contains markup %q:\n%s", markup, txt)
+		}
+	}
+}
+
+// Tests that a full report is built from the tally state alone, without any
+// GitHub interaction.
+func TestStatusFromTally(t *testing.T) {
+	defer func(old func() time.Time) { now = old }(now)
+	now = func() time.Time { return time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC) }
+
+	report := status(markdown, &tally{
+		Final:     "Merged",
+		Commit:    "0123456789abcdef",
+		Votes:     map[string]bool{"alice": true, "bob": true},
+		Stale:     map[string]bool{"carol": false},
+		Reactions: map[string]map[string]struct{}{":tada:": {"dave": {}}},
+		Audit:     []string{"Requested reviews from @erin on Fri Mar 1 11:00:00 UTC 2024"},
+		Muted:     map[string]bool{"bob": true},
+	})
+	want := strings.Join([]string{
+		summaryMarker,
+		"**Merged with 2 approvals**",
+		"_Review state: consensus_",
+		"| Vote | Count | Reviewers |\n" +
+			"| :---: | :---: | :---: |\n" +
+			"| :+1: | 2 | @alice bob |\n" +
+			"| :-1: | 0 |  |\n" +
+			"| :+1: (stale) | 0 |  |\n" +
+			"| :-1: (stale) | 1 | @carol |",
+		"| Reaction | Count | Users |\n" +
+			"| :---: | :---: | :---: |\n" +
+			"| :tada: | 1 | @dave |",
+		"_Robotally: Requested reviews from @erin on Fri Mar 1 11:00:00 UTC 2024_",
+		"_Tally at commit 0123456_",
+		footerMarker,
+		"_Updated: Fri Mar 1 12:00:00 UTC 2024_",
+	}, "\n\n")
+	if report != want {
+		t.Errorf("report mismatch:\nhave:\n%s\nwant:\n%s", report, want)
+	}
+}
+
+// Tests that the report footer is rendered from the configured template, or left
+// out entirely if the template is empty.
+func TestFooterTemplate(t *testing.T) {
+	defer func(template string, line *template.Template, clock func() time.Time) {
+		footerTemplate, footerLine, now = template, line, clock
+	}(footerTemplate, footerLine, now)
+	now = func() time.Time { return time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC) }
+
+	footerTemplate = `Tallied {{.Updated.Format "2006-01-02"}}, see https://example.com/robotally`
+	footerLine = template.Must(template.New("footer").Parse(footerTemplate))
+
+	report := status(markdown, &tally{Votes: map[string]bool{"alice": true}})
+	if want := "\n\n" + footerMarker + "\n\n_Tallied 2024-03-01, see https://example.com/robotally_"; !strings.HasSuffix(report, want) {
+		t.Errorf("custom footer mismatch: want suffix %q in\n%s", want, report)
+	}
+	if substance(report) != strings.TrimSuffix(report, footerMarker+"\n\n_Tallied 2024-03-01, see https://example.com/robotally_") {
+		t.Errorf("custom footer not stripped from the substance:\n%s", substance(report))
+	}
+	footerTemplate = ""
+	footerLine = template.Must(template.New("footer").Parse(footerTemplate))
+
+	report = status(markdown, &tally{Votes: map[string]bool{"alice": true}})
+	if strings.Contains(report, footerMarker) || strings.Contains(report, "Updated") {
+		t.Errorf("footer rendered from an empty template:\n%s", report)
+	}
+	if !strings.HasSuffix(report, "| :-1: | 0 |  |") {
+		t.Errorf("report not ending with the votes table:\n%s", report)
+	}
+	if substance(report) != report {
+		t.Errorf("footerless report trimmed:\n%s", substance(report))
+	}
+}
+
+// Tests that the progress toward the threshold is rendered as a bar, clamped to
+// its bounds, in both formats.
+func TestProgressBar(t *testing.T) {
+	tests := []struct {
+		format      format
+		done, total int
+		bar         string
+	}{
+		{markdown, 2, 3, "🟩🟩⬜ 2/3"},
+		{markdown, -1, 2, "⬜⬜ 0/2"},
+		{markdown, 5, 2, "🟩🟩 2/2"},
+		{plain, 2, 3, "[##-] 2/3"},
+	}
+	for i, tt := range tests {
+		if bar := tt.format.progress(tt.done, tt.total); bar != tt.bar {
+			t.Errorf("test %d: progress bar mismatch: have %q, want %q", i, bar, tt.bar)
+		}
+	}
+	defer func(enabled bool, limit int) { progressBar, threshold = enabled, limit }(progressBar, threshold)
+	progressBar, threshold = true, 3
+
+	report := status(markdown, &tally{Votes: map[string]bool{"alice": true, "bob": true}})
+	if !strings.Contains(report, "\n\n🟩🟩⬜ 2/3") {
+		t.Errorf("progress bar missing:\n%s", report)
+	}
+}
+
+// Tests that the report footer is timestamped with the injected clock, rendered
+// in UTC whatever the clock's zone.
+func TestFixedClockFooter(t *testing.T) {
+	defer func(old func() time.Time) { now = old }(now)
+	now = func() time.Time { return time.Date(2024, 3, 1, 14, 30, 5, 0, time.FixedZone("CET", 3600)) }
+
+	report := status(markdown, &tally{})
+	if want := "\n\n" + footerMarker + "\n\n_Updated: Fri Mar 1 13:30:05 UTC 2024_"; !strings.HasSuffix(report, want) {
+		t.Errorf("footer mismatch: want suffix %q in\n%s", want, report)
+	}
+	if report := status(plain, &tally{}); !strings.HasSuffix(report, "\n\nUpdated: Fri Mar 1 13:30:05 UTC 2024") {
+		t.Errorf("plain footer mismatch:\n%s", report)
+	}
+}
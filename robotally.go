@@ -3,32 +3,111 @@
 package robotally
 
 import (
+	"bytes"
 	"crypto/hmac"
 	"crypto/sha1"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"net/url"
 	"regexp"
 	"sort"
+	"strconv"
 	"strings"
+	"text/template"
 	"time"
 
 	"github.com/google/go-github/github"
+	"golang.org/x/net/context"
 	"golang.org/x/oauth2"
 	"google.golang.org/appengine"
+	"google.golang.org/appengine/log"
 )
 
 // Disabled emojis to not count certain common reactions.
-var disabled = map[string]bool{":+1": true, ":-1": true}
+var disabled = map[string]bool{":+1:": true, ":-1:": true}
 
-// Pass all requests through a single handler
+// Patterns used to parse comments and reports, compiled once.
+var (
+	emojiPattern     = shortcodes()                                                 // Emoji in a comment
+	warningPattern   = regexp.MustCompile("(?m)^:exclamation: (.*) :exclamation:$") // Warning in a report
+	footerPattern    = regexp.MustCompile(`\n\n[^\n]*$`)                            // Footer closing a report
+	referencePattern = regexp.MustCompile(`(?:^|\s)#(\d+)\b`)                       // Reference to another PR
+)
+
+// shortcodes creates the pattern matching emoji shortcodes, from GitHub's own set
+// of lowercase letters, digits, underscores, plus and minus signs (e.g. :+1: or
+// :e-mail:), extended with uppercase letters for custom org emojis if enabled.
+func shortcodes() *regexp.Regexp {
+	if customEmoji {
+		return regexp.MustCompile(`:[A-Za-z0-9_+-]+:`)
+	}
+	return regexp.MustCompile(`:[a-z0-9_+-]+:`)
+}
+
+// emojis finds all the emoji shortcodes in a text, skipping the matches touching
+// a digit on either side, which are times or ranges instead (e.g. 10:30-11:45).
+func emojis(text string) []string {
+	var found []string
+	for offset := 0; offset < len(text); {
+		loc := emojiPattern.FindStringIndex(text[offset:])
+		if loc == nil {
+			break
+		}
+		start, end := offset+loc[0], offset+loc[1]
+		if (start > 0 && isDigit(text[start-1])) || (end < len(text) && isDigit(text[end])) {
+			offset = start + 1
+			continue
+		}
+		found = append(found, text[start:end])
+		offset = end
+	}
+	return found
+}
+
+// isDigit reports whether a byte is an ASCII decimal digit.
+func isDigit(c byte) bool {
+	return '0' <= c && c <= '9'
+}
+
+// now is the clock reports and records are timestamped with, replaceable to get
+// deterministic output.
+var now = time.Now
+
+// Invisible markers identifying the status report comments and the start of
+// their footers.
+const (
+	summaryMarker = "<!-- robotally:summary -->"
+	footerMarker  = "<!-- robotally:footer -->"
+)
+
+// legacyHeader is the header of the votes table, identifying the status reports
+// posted before they were marked.
+const legacyHeader = "| Vote | Count | Reviewers |"
+
+// Maximum length of a GitHub comment, beyond which reactions are collapsed.
+const maxReportSize = 65536
+
+// footerLine is the parsed template of the line closing each report.
+var footerLine = template.Must(template.New("footer").Parse(footerTemplate))
+
+// Pass all webhook requests through a single handler, next to the admin ones
 func init() {
 	http.HandleFunc("/", handler)
+	http.HandleFunc("/reprocess", reprocessHandler)
+	http.HandleFunc("/tasks/refresh", refreshTaskHandler)
+	http.HandleFunc("/selftest", selftestHandler)
+	http.HandleFunc("/cron/refresh", cronHandler)
 }
 
-// handler is the global HTTP request handler processing the GitHub webhook events.
+// handler is the global HTTP request handler processing the GitHub webhook events,
+// passing GitLab ones on to their own handler if GitLab is configured.
 func handler(w http.ResponseWriter, r *http.Request) {
+	if gitlabToken != "" && r.Header.Get("X-Gitlab-Event") != "" {
+		gitlabHandler(w, r)
+		return
+	}
 	ctx := appengine.NewContext(r)
 
 	// Read the entire request body
@@ -60,158 +139,1377 @@ func handler(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Unauthorized request", http.StatusUnauthorized)
 		return
 	}
-	// Decode any GitHub event, and check for outside "opened" or "created" actions exclusively
+	// Decode any GitHub event, and check for outside supported actions exclusively
 	e := new(Event)
 	if err := json.Unmarshal(body, e); err != nil {
 		http.Error(w, "Invalid GitHub event", http.StatusBadRequest)
 		return
 	}
-	if e.Sender.Login == githubUser {
+	if e.Sender.login() == githubUser {
 		return
 	}
-	if (e.Action != "opened" || e.PullRequest == nil) && (e.Action != "created" || e.Issue == nil) {
+	if !supported(e) {
 		http.Error(w, "Unsupported method", http.StatusMethodNotAllowed)
 		return
 	}
+	if len(allowedRepos) > 0 {
+		if e.Repository == nil || !allowedRepos[e.Repository.FullName] {
+			log.Infof(ctx, "Ignoring event from non-allowlisted repository: %+v", e.Repository)
+			return
+		}
+	}
+	// Report what was done as JSON if requested by an admin (e.g. for integration tests)
+	out := &outcome{Action: "skipped"}
+	if r.Header.Get("X-Robotally-Debug") != "" && authorized(r) {
+		rec := &recorder{ResponseWriter: w}
+		defer func() {
+			if !rec.failed {
+				w.Header().Set("Content-Type", "application/json")
+				json.NewEncoder(w).Encode(out)
+			}
+		}()
+		w = rec
+	}
 	// Create an authenticated GitHub client
-	auth := oauth2.NewClient(ctx, oauth2.StaticTokenSource(
-		&oauth2.Token{AccessToken: githubToken},
-	))
-	client := github.NewClient(auth)
+	client := newClient(ctx)
 
 	// Handle the event, depending whether creation or comment
 	switch e.Action {
 	case "opened":
 		// A new issue or pull request was opened, add an empty status report to it
-		warning := ""
-		if e.PullRequest.Base.Branch == "master" {
-			warning = "Pull request against `master`"
+		if !gated(e.PullRequest.Labels) || botAuthored(e.PullRequest.User.login()) || deferReport {
+			return
 		}
-		report := status(warning, nil, nil)
-		if _, _, err := client.Issues.CreateComment(e.Repository.Owner.Login, e.Repository.Name, e.PullRequest.Number, &github.IssueComment{Body: &report}); err != nil {
-			http.Error(w, fmt.Sprintf("Failed to comment on issue: %v", err), http.StatusInternalServerError)
+		if !createOnOpen {
+			log.Infof(ctx, "Not creating report on %s#%d, edit only", e.Repository.FullName, e.PullRequest.Number)
 			return
 		}
+		// Look up the size of the diff if large ones are to be warned about
+		changed := 0
+		if largeDiff > 0 {
+			pr, _, err := client.PullRequests.Get(e.Repository.Owner.Login, e.Repository.Name, e.PullRequest.Number)
+			if err != nil {
+				http.Error(w, fmt.Sprintf("Failed to retrieve pull request: %v", err), errorStatus(err))
+				return
+			}
+			changed = diffSize(pr)
+		}
+		warnings := prWarnings(e.PullRequest.Base.Branch, e.PullRequest.User.login(), changed)
+		sha := e.PullRequest.Head.SHA
 
-	case "created":
-		// A comment was added, gather all reactions
-		comments, _, err := client.Issues.ListComments(e.Repository.Owner.Login, e.Repository.Name, e.Issue.Number, &github.IssueListCommentsOptions{Sort: "created"})
+		report := status(markdown, &tally{Link: e.PullRequest.HTMLURL, Warnings: warnings, Commit: sha})
+		comment, _, err := client.Issues.CreateComment(e.Repository.Owner.Login, e.Repository.Name, e.PullRequest.Number, &github.IssueComment{Body: &report})
 		if err != nil {
-			http.Error(w, fmt.Sprintf("Failed to list comments: %v", err), http.StatusInternalServerError)
+			http.Error(w, fmt.Sprintf("Failed to comment on issue: %v", err), errorStatus(err))
 			return
 		}
-		// Aggregate the votes from every comment and retain any warning messages
-		votes, reactions := aggregate(comments)
+		if err := saveRecord(ctx, e.Repository.FullName, e.PullRequest.Number, *comment.ID, sha, report); err != nil {
+			http.Error(w, fmt.Sprintf("Failed to store tally record: %v", err), errorStatus(err))
+			return
+		}
+		out.Action, out.CommentID = "created", *comment.ID
 
-		warning := ""
-		for _, comment := range comments {
-			if *comment.User.Login == githubUser {
-				if matches := regexp.MustCompile(":exclamation: (.*) :exclamation:").FindAllStringSubmatch(comment.String(), -1); len(matches) > 0 {
-					warning = matches[0][1]
-				}
+		if checkRuns {
+			if err := publishCheck(ctx, client, e.Repository.Owner.Login, e.Repository.Name, e.PullRequest.Number, new(Record), &tally{Commit: sha}, report); err != nil {
+				http.Error(w, fmt.Sprintf("Failed to publish check run: %v", err), errorStatus(err))
+				return
 			}
 		}
-		// Generate a fresh status report and edit the old one
-		report := status(warning, votes, reactions)
-		for _, comment := range comments {
-			if *comment.User.Login == githubUser {
-				if _, _, err := client.Issues.EditComment(e.Repository.Owner.Login, e.Repository.Name, *comment.ID, &github.IssueComment{Body: &report}); err != nil {
-					http.Error(w, fmt.Sprintf("Failed to update issue report: %v", err), http.StatusInternalServerError)
+
+	case "created":
+		// A comment was added, skip plain issues as only pull requests are tallied
+		if e.Issue.PullRequest == nil || !gated(e.Issue.Labels) {
+			return
+		}
+		// Commands are only accepted from known users, not deleted ones
+		commenter := e.Comment.User.login()
+		if commenter == "" {
+			log.Warningf(ctx, "Ignoring commands in comment %d without author", e.Comment.ID)
+		}
+		// Opt the pull request out of (or back into) tallying if a collaborator requested
+		if enable, ok := tallyCommand(e.Comment.Body); ok && commenter != "" {
+			allowed, _, err := client.Repositories.IsCollaborator(e.Repository.Owner.Login, e.Repository.Name, commenter)
+			if err != nil {
+				http.Error(w, fmt.Sprintf("Failed to check collaborator: %v", err), errorStatus(err))
+				return
+			}
+			if allowed {
+				if err := optOut(ctx, client, e.Repository.Owner.Login, e.Repository.Name, e.Issue.Number, !enable); err != nil {
+					http.Error(w, fmt.Sprintf("Failed to toggle tallying: %v", err), errorStatus(err))
 					return
 				}
+				out.Action = "toggled"
+				return
+			}
+		}
+		// Store any notification preference changes requested by the commenter
+		if mute, ok := muteCommand(e.Comment.Body); ok && commenter != "" {
+			if err := savePreference(ctx, commenter, mute); err != nil {
+				http.Error(w, fmt.Sprintf("Failed to store notification preference: %v", err), errorStatus(err))
+				return
+			}
+		}
+		if out, err = refresh(ctx, client, e.Repository.Owner.Login, e.Repository.Name, e.Issue.Number, createOnUpdate, false); err != nil {
+			http.Error(w, fmt.Sprintf("Failed to refresh report: %v", err), errorStatus(err))
+			return
+		}
+
+	case "labeled":
+		// A label was added, stop tallying if it's the opt-out one
+		if optOutLabel != "" && e.Label.Name == optOutLabel {
+			if err := optOut(ctx, client, e.Repository.Owner.Login, e.Repository.Name, e.PullRequest.Number, true); err != nil {
+				http.Error(w, fmt.Sprintf("Failed to toggle tallying: %v", err), errorStatus(err))
 				return
 			}
+			out.Action = "toggled"
+			return
+		}
+		// Start tallying if it's the one gating the reports
+		if requiredLabel == "" || e.Label.Name != requiredLabel || !gated(e.PullRequest.Labels) {
+			return
+		}
+		if out, err = refresh(ctx, client, e.Repository.Owner.Login, e.Repository.Name, e.PullRequest.Number, createOnUpdate, false); err != nil {
+			http.Error(w, fmt.Sprintf("Failed to refresh report: %v", err), errorStatus(err))
+			return
+		}
+
+	case "unlabeled":
+		// A label was removed, resume tallying if it was the opt-out one (reporting only if gated in)
+		if optOutLabel != "" && e.Label.Name == optOutLabel {
+			if gated(e.PullRequest.Labels) {
+				err = optOut(ctx, client, e.Repository.Owner.Login, e.Repository.Name, e.PullRequest.Number, false)
+			} else {
+				err = setDisabled(ctx, e.Repository.FullName, e.PullRequest.Number, false)
+			}
+			if err != nil {
+				http.Error(w, fmt.Sprintf("Failed to toggle tallying: %v", err), errorStatus(err))
+				return
+			}
+			out.Action = "toggled"
+			return
+		}
+		// Stop tallying if it was the one gating the reports
+		if requiredLabel == "" || e.Label.Name != requiredLabel || !removeUngated {
+			return
+		}
+		if err := removeSummary(ctx, client, e.Repository.Owner.Login, e.Repository.Name, e.PullRequest.Number); err != nil {
+			http.Error(w, fmt.Sprintf("Failed to delete issue report: %v", err), errorStatus(err))
+			return
+		}
+		out.Action = "deleted"
+
+	case "closed":
+		// The pull request was closed, remove the live report if requested (keeping the stored record)
+		if deleteOnClose {
+			if err := removeSummary(ctx, client, e.Repository.Owner.Login, e.Repository.Name, e.PullRequest.Number); err != nil {
+				http.Error(w, fmt.Sprintf("Failed to delete issue report: %v", err), errorStatus(err))
+				return
+			}
+			out.Action = "deleted"
+			return
+		}
+		// Otherwise finalize the report with the outcome, freezing it if requested
+		final := "Closed without merge"
+		if e.PullRequest.Merged {
+			final = "Merged"
+		}
+		if err := setFinal(ctx, e.Repository.FullName, e.PullRequest.Number, final); err != nil {
+			http.Error(w, fmt.Sprintf("Failed to store final state: %v", err), errorStatus(err))
+			return
+		}
+		if out, err = refresh(ctx, client, e.Repository.Owner.Login, e.Repository.Name, e.PullRequest.Number, false, false); err != nil {
+			http.Error(w, fmt.Sprintf("Failed to finalize report: %v", err), errorStatus(err))
+			return
+		}
+		if lockOnClose {
+			if err := setFrozen(ctx, e.Repository.FullName, e.PullRequest.Number, true); err != nil {
+				http.Error(w, fmt.Sprintf("Failed to freeze report: %v", err), errorStatus(err))
+				return
+			}
+		}
+
+	case "reopened":
+		// The pull request was reopened, resume tallying it live (reporting only if gated in)
+		if err := clearFinal(ctx, e.Repository.FullName, e.PullRequest.Number); err != nil {
+			http.Error(w, fmt.Sprintf("Failed to clear final state: %v", err), errorStatus(err))
+			return
+		}
+		if !gated(e.PullRequest.Labels) {
+			return
+		}
+		if out, err = refresh(ctx, client, e.Repository.Owner.Login, e.Repository.Name, e.PullRequest.Number, createOnUpdate, false); err != nil {
+			http.Error(w, fmt.Sprintf("Failed to refresh report: %v", err), errorStatus(err))
+			return
+		}
+
+	case "renamed":
+		// The repository was renamed, move all stored state over to the new name
+		from := e.Repository.Owner.Login + "/" + e.Changes.Repository.Name.From
+		if err := migrateRecords(ctx, from, e.Repository.FullName); err != nil {
+			http.Error(w, fmt.Sprintf("Failed to migrate tally records: %v", err), errorStatus(err))
+			return
+		}
+		out.Action = "migrated"
+	}
+}
+
+// newClient creates a GitHub API client authenticated with the bot's token,
+// throttled to stay within GitHub's secondary rate limits.
+func newClient(ctx context.Context) *github.Client {
+	auth := oauth2.NewClient(ctx, oauth2.StaticTokenSource(
+		&oauth2.Token{AccessToken: githubToken},
+	))
+	auth.Transport = &throttledTransport{base: auth.Transport, throttle: throttleOf(githubToken)}
+
+	client := github.NewClient(auth)
+	if endpoint, err := url.Parse(githubURL); err == nil {
+		client.BaseURL = endpoint
+	}
+	return client
+}
+
+// refresh gathers all the comments of a pull request, aggregates the votes and
+// reactions from them and updates the status report with the fresh tally. If
+// no report exists yet, a new one is only posted if create is set. The report is
+// only edited if the tally changed, unless force is set. Refreshes of the same
+// PR are serialized to avoid concurrent events clobbering each other.
+func refresh(ctx context.Context, client *github.Client, owner, repo string, number int, create bool, force bool) (*outcome, error) {
+	unlock, err := lock(ctx, owner+"/"+repo, number)
+	if err != nil {
+		return nil, failed("lock pull request", err)
+	}
+	defer unlock()
+
+	out := &outcome{Action: "skipped"}
+
+	comments, associations, err := listComments(client, owner, repo, number)
+	if err != nil {
+		return nil, failed("list comments", err)
+	}
+	record, err := loadRecord(ctx, owner+"/"+repo, number)
+	if err != nil {
+		return nil, failed("load tally record", err)
+	}
+	if record.Disabled || record.Frozen {
+		return out, nil
+	}
+	comment := summary(comments)
+	if comment == nil && record.CommentID == 0 && !create {
+		log.Infof(ctx, "No report on %s/%s#%d to edit, skipping", owner, repo, number)
+		return out, nil
+	}
+	pr, _, err := client.PullRequests.Get(owner, repo, number)
+	if err != nil {
+		return nil, failed("retrieve pull request", err)
+	}
+	if botAuthored(login(pr.User)) {
+		return out, nil
+	}
+	// Aggregate the votes from every comment and retain any warning messages
+	var since time.Time
+	if readyOnly {
+		if since, err = readySince(client, owner, repo, number); err != nil {
+			return nil, failed("resolve draft state", err)
+		}
+	}
+	perms := make(map[string]string)
+
+	maintainers, err := resolvers(client, owner, repo, comments, perms)
+	if err != nil {
+		return nil, failed("check resolver permissions", err)
+	}
+	teams, err := teamMembers(client, comments, make(map[string][]string))
+	if err != nil {
+		return nil, failed("expand team mentions", err)
+	}
+	partners, err := coApprovers(client, owner, repo, comments)
+	if err != nil {
+		return nil, failed("check co-approvers", err)
+	}
+	votes, stale, reactions := aggregate(comments, associations, since, maintainers, teams, partners)
+	excludeAuthor(login(pr.User), votes, stale, reactions)
+	if err := filterVoters(client, owner, repo, votes); err != nil {
+		return nil, failed("filter collaborators", err)
+	}
+	advisory, err := splitAdvisory(client, owner, repo, votes, perms)
+	if err != nil {
+		return nil, failed("check voter permissions", err)
+	}
+	// Hold off on posting a deferred report until the first vote arrives
+	if comment == nil && record.CommentID == 0 && deferReport && len(votes) == 0 && len(advisory) == 0 {
+		return out, nil
+	}
+	missing, err := missingApprovals(client, owner, repo, number, votes, teams)
+	if err != nil {
+		return nil, failed("check required team approvals", err)
+	}
+
+	var warnings []string
+	if comment != nil && comment.Body != nil {
+		for _, match := range warningPattern.FindAllStringSubmatch(*comment.Body, -1) {
+			warnings = append(warnings, match[1])
+		}
+	} else {
+		warnings = prWarnings(*pr.Base.Ref, login(pr.User), diffSize(pr))
+	}
+	// Generate a fresh status report for the current head and edit the old one
+	score := 0.0
+	if urgencyScore {
+		score = urgency(comments, *pr.CreatedAt)
+	}
+	sha := *pr.Head.SHA
+
+	var linked map[int]map[string]bool
+	if linkedPRs && pr.Body != nil {
+		if linked, err = linkedVotes(client, owner, repo, number, *pr.Body, perms); err != nil {
+			return nil, failed("aggregate linked pull requests", err)
+		}
+	}
+	// Reactions are best effort, don't lose the text based tally if they fail
+	var (
+		inline   map[string]map[string]struct{}
+		degraded bool
+	)
+	if inlineVotes {
+		if inline, err = inlineAgreement(client, owner, repo, number); err != nil {
+			log.Warningf(ctx, "Failed to aggregate review comment reactions of %s/%s#%d: %v", owner, repo, number, err)
+			inline, degraded = nil, true
+		}
+	}
+	var forum map[string]map[string]struct{}
+	if discussions && pr.Body != nil {
+		if forum, err = discussionAgreement(client, *pr.Body); err != nil {
+			log.Warningf(ctx, "Failed to aggregate discussion reactions of %s/%s#%d: %v", owner, repo, number, err)
+			forum, degraded = nil, true
+		}
+	}
+	muted, err := mutedUsers(ctx)
+	if err != nil {
+		return nil, failed("load notification preferences", err)
+	}
+	for _, yes := range votes {
+		if yes {
+			out.Up++
+		} else {
+			out.Down++
+		}
+	}
+	// Run the automations on the votes first so the report can account for them
+	if requestChanges {
+		// Automations are best effort, don't stop tallying if e.g. permissions are missing
+		if err := enforceReview(ctx, client, owner, repo, number, record, votes); err != nil {
+			log.Warningf(ctx, "Failed to update changes requested review of %s/%s#%d: %v", owner, repo, number, err)
+		}
+	}
+	if err := nudge(ctx, client, owner, repo, pr, record, votes); err != nil {
+		log.Warningf(ctx, "Failed to request reviewers on %s/%s#%d: %v", owner, repo, number, err)
+	}
+	reviewers, reviewerTeams, err := requestedReviewers(client, owner, repo, number, teams)
+	if err != nil {
+		return nil, failed("list requested reviewers", err)
+	}
+	t := &tally{
+		Link:      *pr.HTMLURL,
+		Warnings:  warnings,
+		Commit:    sha,
+		Final:     record.Final,
+		Votes:     votes,
+		Advisory:  advisory,
+		Stale:     stale,
+		Reactions: reactions,
+		Linked:    linked,
+		Inline:    inline,
+		Forum:     forum,
+		Degraded:  degraded,
+		Missing:   missing,
+		Reviewers: reviewers,
+		Teams:     reviewerTeams,
+		Soft:      softScore(reactions),
+		Score:     score,
+		Muted:     muted,
+	}
+	t.Audit = record.Audit
+	report := status(markdown, t)
+
+	// Skip the edit if only the timestamp would change, avoiding notification churn
+	previous := comment
+	for _, c := range comments {
+		if record.CommentID != 0 && *c.ID == record.CommentID {
+			previous = c
+		}
+	}
+	if force || previous == nil || previous.Body == nil || substance(*previous.Body) != substance(report) {
+		id, err := post(ctx, client, owner, repo, number, record.CommentID, comment, create, report)
+		if err != nil {
+			return nil, err
+		}
+		if id == 0 {
+			return out, nil
+		}
+		if err := saveRecord(ctx, owner+"/"+repo, number, id, sha, report); err != nil {
+			return nil, failed("store tally record", err)
+		}
+		out.Action, out.CommentID = "updated", id
+	} else {
+		out.Action, out.CommentID = "unchanged", *previous.ID
+	}
+	// Publish the check run too, unless it's already up to date with the report
+	if checkRuns && (out.Action == "updated" || record.CheckCommit != sha) {
+		if err := publishCheck(ctx, client, owner, repo, number, record, t, report); err != nil {
+			return nil, failed("publish check run", err)
+		}
+	}
+	return out, nil
+}
+
+// post publishes a status report, editing the stored report comment directly if
+// available, falling back to the searched one, or creating a new one if allowed.
+// If the searched comment is deleted mid-flight, the report is posted anew. The
+// identifier of the updated comment is returned, or 0 if nothing was posted.
+func post(ctx context.Context, client *github.Client, owner, repo string, number int, id int, comment *github.IssueComment, create bool, report string) (int, error) {
+	if id != 0 {
+		_, _, err := client.Issues.EditComment(owner, repo, id, &github.IssueComment{Body: &report})
+		if err == nil {
+			return id, nil
+		}
+		if !notFound(err) {
+			return 0, failed("update issue report", err)
+		}
+	}
+	if comment != nil {
+		_, _, err := client.Issues.EditComment(owner, repo, *comment.ID, &github.IssueComment{Body: &report})
+		if err == nil {
+			return *comment.ID, nil
+		}
+		if !notFound(err) {
+			return 0, failed("update issue report", err)
+		}
+		log.Warningf(ctx, "Report comment %d of %s/%s#%d vanished", *comment.ID, owner, repo, number)
+		create = create || createOnUpdate
+	}
+	if !create {
+		return 0, nil
+	}
+	comment, _, err := client.Issues.CreateComment(owner, repo, number, &github.IssueComment{Body: &report})
+	if err != nil {
+		return 0, failed("comment on issue", err)
+	}
+	return *comment.ID, nil
+}
+
+// substance strips the footer (containing the update timestamp) from a status
+// report, leaving only the parts that change when the tally itself changes. The
+// footer is found by its marker, falling back to the last line for reports
+// rendered before markers were added.
+func substance(report string) string {
+	if footerTemplate == "" {
+		return report
+	}
+	if index := strings.Index(report, footerMarker); index >= 0 {
+		return report[:index]
+	}
+	return footerPattern.ReplaceAllString(report, "")
+}
+
+// optOut disables (or re-enables) tallying on a pull request, removing the status
+// report when disabling and posting a fresh one when enabling.
+func optOut(ctx context.Context, client *github.Client, owner, repo string, number int, disable bool) error {
+	if err := setDisabled(ctx, owner+"/"+repo, number, disable); err != nil {
+		return err
+	}
+	if disable {
+		return removeSummary(ctx, client, owner, repo, number)
+	}
+	_, err := refresh(ctx, client, owner, repo, number, true, false)
+	return err
+}
+
+// removeSummary deletes the status report comment of a pull request, if any.
+// The stored comment is deleted directly, falling back to searching for it.
+func removeSummary(ctx context.Context, client *github.Client, owner, repo string, number int) error {
+	record, err := loadRecord(ctx, owner+"/"+repo, number)
+	if err != nil {
+		return err
+	}
+	if record.CommentID != 0 {
+		_, err := client.Issues.DeleteComment(owner, repo, record.CommentID)
+		if err != nil && !notFound(err) {
+			return err
+		}
+		if err == nil {
+			return setCommentID(ctx, owner+"/"+repo, number, 0)
+		}
+	}
+	comments, _, err := listComments(client, owner, repo, number)
+	if err != nil {
+		return err
+	}
+	if comment := summary(comments); comment != nil {
+		if _, err := client.Issues.DeleteComment(owner, repo, *comment.ID); err != nil {
+			return err
+		}
+	}
+	return setCommentID(ctx, owner+"/"+repo, number, 0)
+}
+
+// notFound reports whether a GitHub API error is a not found response.
+func notFound(err error) bool {
+	if err, ok := err.(*github.ErrorResponse); ok {
+		return err.Response != nil && err.Response.StatusCode == http.StatusNotFound
+	}
+	return false
+}
+
+// prWarnings gathers all the warnings to display for a new pull request, given
+// its base branch, author and number of changed lines.
+func prWarnings(base string, author string, changed int) []string {
+	var warnings []string
+	if warning := branchWarning(base, author); warning != "" {
+		warnings = append(warnings, warning)
+	}
+	if largeDiff > 0 && changed > largeDiff {
+		warnings = append(warnings, fmt.Sprintf("Large PR: %d lines changed", changed))
+	}
+	return warnings
+}
+
+// diffSize counts the lines added and deleted by a pull request.
+func diffSize(pr *github.PullRequest) int {
+	changed := 0
+	if pr.Additions != nil {
+		changed += *pr.Additions
+	}
+	if pr.Deletions != nil {
+		changed += *pr.Deletions
+	}
+	return changed
+}
+
+// branchWarning generates the warning to display for PRs against a base branch,
+// unless the author of the PR is exempt from it.
+func branchWarning(base string, author string) string {
+	if base == "master" && !warningExempt[author] {
+		return "Pull request against `master`"
+	}
+	return ""
+}
+
+// gated reports whether a pull request with the given labels is to be tallied,
+// having the required label (if any) and not the opt-out one.
+func gated(labels []*Label) bool {
+	required := requiredLabel == ""
+	for _, label := range labels {
+		if optOutLabel != "" && label.Name == optOutLabel {
+			return false
+		}
+		if label.Name == requiredLabel {
+			required = true
+		}
+	}
+	return required
+}
+
+// botAuthored reports whether a pull request author matches the bot pattern.
+func botAuthored(author string) bool {
+	return botAuthors != nil && botAuthors.MatchString(author)
+}
+
+// supported reports whether an event is one that robotally knows how to handle.
+func supported(e *Event) bool {
+	switch e.Action {
+	case "opened", "closed", "reopened":
+		return e.PullRequest != nil
+	case "labeled", "unlabeled":
+		return e.PullRequest != nil && e.Label != nil
+	case "created":
+		return e.Issue != nil && e.Comment != nil
+	case "renamed":
+		return e.Changes != nil && e.Changes.Repository != nil && e.Changes.Repository.Name != nil
+	}
+	return false
+}
+
+// tallyCommand checks whether a comment contains a tallying opt-out command,
+// returning whether tallying should be turned on or off.
+func tallyCommand(body string) (bool, bool) {
+	for _, line := range strings.Split(body, "\n") {
+		switch strings.TrimSpace(line) {
+		case "/tally on":
+			return true, true
+		case "/tally off":
+			return false, true
+		}
+	}
+	return false, false
+}
+
+// muteCommand checks whether a comment contains a notification preference
+// command, returning whether the user wants to be muted or unmuted.
+func muteCommand(body string) (bool, bool) {
+	for _, line := range strings.Split(body, "\n") {
+		switch strings.TrimSpace(line) {
+		case "/tally mute":
+			return true, true
+		case "/tally unmute":
+			return false, true
+		}
+	}
+	return false, false
+}
+
+// summary finds the status report comment among the comments of a PR, by its
+// marker so that other comments of the bot are not mistaken for it. If the bot
+// may never create reports, marked comments seeded by humans are adopted too.
+// Reports posted before markers were added are found by their votes table.
+func summary(comments []*github.IssueComment) *github.IssueComment {
+	seeded := !createOnOpen && !createOnUpdate
+	for _, comment := range comments {
+		if (seeded || login(comment.User) == githubUser) && comment.Body != nil && strings.Contains(*comment.Body, summaryMarker) {
+			return comment
+		}
+	}
+	for _, comment := range comments {
+		if login(comment.User) == githubUser && comment.Body != nil && strings.Contains(*comment.Body, legacyHeader) {
+			return comment
+		}
+	}
+	return nil
+}
+
+// listComments retrieves all the comments of an issue or pull request, oldest
+// first. Vote aggregation relies on this order for the latest vote of a user to
+// win, so it's enforced locally too instead of trusting the API's sort alone.
+// The author associations of the comments are returned keyed by comment ID, as
+// the API client doesn't expose them.
+func listComments(client *github.Client, owner, repo string, number int) ([]*github.IssueComment, map[int]string, error) {
+	var (
+		comments     []*github.IssueComment
+		associations = make(map[int]string)
+	)
+	for page := 1; page != 0; {
+		req, err := client.NewRequest("GET", fmt.Sprintf("repos/%v/%v/issues/%d/comments?sort=created&direction=asc&per_page=100&page=%d", owner, repo, number, page), nil)
+		if err != nil {
+			return nil, nil, err
+		}
+		var batch []*struct {
+			github.IssueComment
+			AuthorAssociation string `json:"author_association"`
+		}
+		res, err := client.Do(req, &batch)
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, comment := range batch {
+			if comment.ID != nil {
+				associations[*comment.ID] = comment.AuthorAssociation
+			}
+			comments = append(comments, &comment.IssueComment)
+		}
+		page = res.NextPage
+	}
+	chronological(comments)
+	return comments, associations, nil
+}
+
+// chronological orders comments by creation time, breaking ties between those
+// created at the same instant (e.g. imported ones) by their ID, so that the last
+// vote of a user is resolved deterministically.
+func chronological(comments []*github.IssueComment) {
+	created := func(comment *github.IssueComment) time.Time {
+		if comment.CreatedAt == nil {
+			return time.Time{}
+		}
+		return *comment.CreatedAt
+	}
+	sort.SliceStable(comments, func(i, j int) bool {
+		if ti, tj := created(comments[i]), created(comments[j]); !ti.Equal(tj) {
+			return ti.Before(tj)
+		}
+		return *comments[i].ID < *comments[j].ID
+	})
+}
+
+// login returns the username of a GitHub user, or an empty string if the user
+// is missing from the API response (e.g. a deleted ghost account).
+func login(user *github.User) string {
+	if user == nil || user.Login == nil {
+		return ""
+	}
+	return *user.Login
+}
+
+// automated reports whether a comment is maintained by the bot, either posted by
+// it or holding a status report seeded by someone else. Such comments repeat
+// the votes and reactions of others, so they must not be tallied themselves.
+func automated(comment *github.IssueComment) bool {
+	return login(comment.User) == githubUser || (comment.Body != nil && strings.Contains(*comment.Body, summaryMarker))
+}
+
+// readySince resolves the time since when a pull request has been ready for
+// review. A PR never in draft returns the zero time, one still in draft the
+// current time.
+func readySince(client *github.Client, owner, repo string, number int) (time.Time, error) {
+	inDraft, err := draft(client, owner, repo, number)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if inDraft {
+		return now(), nil
+	}
+	// Not a draft now, find the last time it was marked ready for review
+	var since time.Time
+
+	opt := &github.ListOptions{PerPage: 100}
+	for {
+		events, res, err := client.Issues.ListIssueEvents(owner, repo, number, opt)
+		if err != nil {
+			return time.Time{}, err
+		}
+		for _, event := range events {
+			if event.Event != nil && *event.Event == "ready_for_review" && event.CreatedAt != nil && event.CreatedAt.After(since) {
+				since = *event.CreatedAt
+			}
+		}
+		if res == nil || res.NextPage == 0 {
+			break
+		}
+		opt.Page = res.NextPage
+	}
+	return since, nil
+}
+
+// draft reports whether a pull request is currently a draft. The flag is only
+// returned by the draft pull requests API preview, which go-github predates.
+func draft(client *github.Client, owner, repo string, number int) (bool, error) {
+	req, err := client.NewRequest("GET", fmt.Sprintf("repos/%v/%v/pulls/%d", owner, repo, number), nil)
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Accept", "application/vnd.github.shadow-cat-preview+json")
+
+	pr := new(struct {
+		Draft bool `json:"draft"`
+	})
+	if _, err := client.Do(req, pr); err != nil {
+		return false, err
+	}
+	return pr.Draft, nil
+}
+
+// voting reports whether an emoji is one of those mapped to up or down votes.
+func voting(emoji string) bool {
+	return emoji == upvoteEmoji || emoji == downvoteEmoji
+}
+
+// ballot extracts the part of a comment votes are cast in. If a vote marker is
+// configured, that's only the lines starting with it, the emojis in the rest of
+// the prose counting as reactions only.
+func ballot(comment *github.IssueComment) string {
+	if voteMarker == "" {
+		return comment.String()
+	}
+	if comment.Body == nil {
+		return ""
+	}
+	var lines []string
+	for _, line := range strings.Split(*comment.Body, "\n") {
+		if line = strings.TrimSpace(line); strings.HasPrefix(line, voteMarker) {
+			lines = append(lines, line)
 		}
 	}
+	return strings.Join(lines, "\n")
+}
+
+// associated reports whether the author association of a comment (e.g. member,
+// collaborator or forking contributor) is one whose votes are counted. Comments
+// of unknown association only count if no filtering is configured.
+func associated(comment *github.IssueComment, associations map[int]string) bool {
+	if len(voterAssociations) == 0 {
+		return true
+	}
+	return comment.ID != nil && voterAssociations[associations[*comment.ID]]
 }
 
 // aggregate iterates over all the comments of a PR and aggregates the review
-// votes and any other allowed emoji reactions.
-func aggregate(comments []github.IssueComment) (map[string]bool, map[string]map[string]struct{}) {
+// votes and any other allowed emoji reactions. Comments created before since
+// are ignored, as are the votes from authors without a counted association.
+// Blocking downvotes are cleared when marked resolved by their objector or by
+// one of the given maintainers. Votes mentioning one of the given teams are
+// attributed to all its members too, and upvotes naming one of the given
+// co-approving partners to them as well. Votes older than the freshness window
+// are returned separately as stale ones.
+func aggregate(comments []*github.IssueComment, associations map[int]string, since time.Time, maintainers map[string]bool, teams map[string][]string, partners map[string]bool) (map[string]bool, map[string]bool, map[string]map[string]struct{}) {
 	votes := make(map[string]bool)
+	stale := make(map[string]bool)
 	reactions := make(map[string]map[string]struct{})
 
 	// Iterate all the comments and extract the reactions
 	for _, comment := range comments {
-		// Short circuit if our own comment
-		if *comment.User.Login == githubUser {
+		// Short circuit if our own comment, or the author is unknown
+		user := login(comment.User)
+		if automated(comment) || user == "" {
 			continue
 		}
-		// Scan through the comment and find and up or down votes
-		if strings.Contains(comment.String(), ":+1:") {
-			votes[*comment.User.Login] = true
-		} else if strings.Contains(comment.String(), ":-1:") {
-			votes[*comment.User.Login] = false
-		}
-		// Find all other emojis withn the comment
-		emojis := regexp.MustCompile(":[a-z0-9_]+:")
-		for _, emoji := range emojis.FindAllString(comment.String(), -1) {
-			if !disabled[emoji] {
-				// Make sure we have a valid user set
-				if _, ok := reactions[emoji]; !ok {
-					reactions[emoji] = make(map[string]struct{})
+		// Skip any comments made before the cutoff time (e.g. while in draft)
+		if comment.CreatedAt != nil && comment.CreatedAt.Before(since) {
+			continue
+		}
+		// Scan through the comment and find and up or down votes from intended voters
+		if associated(comment, associations) {
+			text := ballot(comment)
+
+			voted, vote := false, false
+			if strings.Contains(text, upvoteEmoji) {
+				voted, vote = true, true
+			} else if strings.Contains(text, downvoteEmoji) {
+				voted, vote = true, false
+			}
+			if voted {
+				ballot := votes
+				if freshness > 0 && comment.CreatedAt != nil && comment.CreatedAt.Before(now().Add(-freshness)) {
+					ballot = stale
+				}
+				ballot[user] = vote
+				for _, match := range teamMention.FindAllStringSubmatch(text, -1) {
+					for _, member := range teams[match[1]] {
+						ballot[member] = vote
+					}
+				}
+				if vote {
+					for _, match := range coApproval.FindAllStringSubmatch(text, -1) {
+						if partners[match[1]] {
+							ballot[match[1]] = true
+						}
+					}
+				}
+			}
+		}
+		// Neutralize any blocking concerns the comment marks as resolved
+		if resolvedEmoji != "" && strings.Contains(comment.String(), resolvedEmoji) {
+			if maintainers[user] {
+				for user, yes := range votes {
+					if !yes {
+						delete(votes, user)
+					}
 				}
-				reactions[emoji][*comment.User.Login] = struct{}{}
+			} else if yes, ok := votes[user]; ok && !yes {
+				delete(votes, user)
+			}
+		}
+		// Find all other emojis withn the comment (only testers and weighted ones if reactions are hidden)
+		if !reactionTable && testedEmoji == "" && len(softWeights) == 0 {
+			continue
+		}
+		for _, emoji := range emojis(comment.String()) {
+			if disabled[emoji] || voting(emoji) || (!reactionTable && emoji != testedEmoji && softWeights[emoji] == 0) {
+				continue
+			}
+			// Make sure we have a valid user set
+			if _, ok := reactions[emoji]; !ok {
+				reactions[emoji] = make(map[string]struct{})
+			}
+			reactions[emoji][user] = struct{}{}
+		}
+	}
+	// Drop the stale votes of anyone who voted again since
+	for user := range votes {
+		delete(stale, user)
+	}
+	return votes, stale, reactions
+}
+
+// inlineAgreement gathers the thumbs up and down reactions on the review comments
+// of a PR, keyed by the vote emoji they map to. These signal agreement with the
+// specific line comments, not with the PR as a whole.
+func inlineAgreement(client *github.Client, owner, repo string, number int) (map[string]map[string]struct{}, error) {
+	inline := map[string]map[string]struct{}{
+		upvoteEmoji:   make(map[string]struct{}),
+		downvoteEmoji: make(map[string]struct{}),
+	}
+	// Gather all the review comments, paging through however many there are
+	var comments []*github.PullRequestComment
+
+	opt := &github.PullRequestListCommentsOptions{ListOptions: github.ListOptions{PerPage: 100}}
+	for {
+		page, res, err := client.PullRequests.ListComments(owner, repo, number, opt)
+		if err != nil {
+			return nil, err
+		}
+		comments = append(comments, page...)
+		if res == nil || res.NextPage == 0 {
+			break
+		}
+		opt.Page = res.NextPage
+	}
+	// Collect the vote reactions of each review comment, across all pages too
+	for _, comment := range comments {
+		opt := &github.ListOptions{PerPage: 100}
+		for {
+			reactions, res, err := client.Reactions.ListPullRequestCommentReactions(owner, repo, *comment.ID, opt)
+			if err != nil {
+				return nil, err
+			}
+			for _, reaction := range reactions {
+				user := login(reaction.User)
+				if user == githubUser || user == "" || reaction.Content == nil {
+					continue
+				}
+				switch *reaction.Content {
+				case "+1":
+					inline[upvoteEmoji][user] = struct{}{}
+				case "-1":
+					inline[downvoteEmoji][user] = struct{}{}
+				}
+			}
+			if res == nil || res.NextPage == 0 {
+				break
+			}
+			opt.Page = res.NextPage
+		}
+	}
+	return inline, nil
+}
+
+// softScore sums the configured fractional weights of the emoji reactions, each
+// user contributing at most once per emoji.
+func softScore(reactions map[string]map[string]struct{}) float64 {
+	score := 0.0
+	for emoji, weight := range softWeights {
+		score += weight * float64(len(reactions[emoji]))
+	}
+	return score
+}
+
+// excludeAuthor drops the votes and reactions of the pull request author from
+// the aggregated tally, if configured not to count them.
+func excludeAuthor(author string, votes, stale map[string]bool, reactions map[string]map[string]struct{}) {
+	if !authorVotes {
+		delete(votes, author)
+		delete(stale, author)
+	}
+	if !authorEmojis {
+		for emoji, users := range reactions {
+			if delete(users, author); len(users) == 0 {
+				delete(reactions, emoji)
+			}
+		}
+	}
+}
+
+// linkedVotes aggregates the votes of all the other pull requests referenced
+// from the body of a PR, filtered the same way as the PR's own binding votes.
+// References to plain issues are skipped, and references are only followed one
+// level deep.
+func linkedVotes(client *github.Client, owner, repo string, number int, body string, perms map[string]string) (map[int]map[string]bool, error) {
+	linked := make(map[int]map[string]bool)
+	for _, match := range referencePattern.FindAllStringSubmatch(body, -1) {
+		ref, err := strconv.Atoi(match[1])
+		if err != nil || ref == number {
+			continue
+		}
+		if _, ok := linked[ref]; ok {
+			continue
+		}
+		issue, _, err := client.Issues.Get(owner, repo, ref)
+		if err != nil {
+			if notFound(err) {
+				continue
 			}
+			return nil, err
+		}
+		if issue.PullRequestLinks == nil {
+			continue
+		}
+		comments, associations, err := listComments(client, owner, repo, ref)
+		if err != nil {
+			return nil, err
+		}
+		votes, stale, _ := aggregate(comments, associations, time.Time{}, nil, nil, nil)
+		excludeAuthor(login(issue.User), votes, stale, nil)
+		if err := filterVoters(client, owner, repo, votes); err != nil {
+			return nil, err
+		}
+		if _, err := splitAdvisory(client, owner, repo, votes, perms); err != nil {
+			return nil, err
+		}
+		linked[ref] = votes
+	}
+	return linked, nil
+}
+
+// agreement derives whether the reviewers are in consensus (all votes pointing
+// the same way) or contested (both up and down votes present). An even split
+// is reported as tied along with its configured outcome. With no votes at all,
+// there's no state to speak of.
+func agreement(up, down int) string {
+	switch {
+	case !consensus && reviewerRatio == 0 && tied(up, down):
+		switch tieVotes {
+		case "pass":
+			return "tied, passing"
+		case "fail":
+			return "tied, failing"
+		default:
+			return "tied"
 		}
+	case up > 0 && down > 0:
+		return "contested"
+	case up > 0 || down > 0:
+		return "consensus"
+	default:
+		return ""
+	}
+}
+
+// tied reports whether there's an even split between up and down votes.
+func tied(up, down int) bool {
+	return up > 0 && up == down
+}
+
+// mention renders a reference to a user, @mentioning them unless opted out.
+func mention(user string, muted map[string]bool) string {
+	if muted[user] {
+		return user
 	}
-	return votes, reactions
+	return "@" + user
 }
 
-// status renders a new status report based on the PR votes as well as any
-// additional allowed emojis.
-func status(warning string, votes map[string]bool, emojis map[string]map[string]struct{}) string {
+// sortMentions orders rendered user references by login, regardless of whether
+// the users are @mentioned or muted.
+func sortMentions(mentions []string) {
+	sort.Slice(mentions, func(i, j int) bool {
+		return strings.TrimPrefix(mentions[i], "@") < strings.TrimPrefix(mentions[j], "@")
+	})
+}
+
+// urgency computes a score of how quickly the PR attracted emoji reactions,
+// weighting each reaction by the inverse of the hours elapsed since opening.
+func urgency(comments []*github.IssueComment, opened time.Time) float64 {
+	score := 0.0
+	for _, comment := range comments {
+		if automated(comment) || login(comment.User) == "" || comment.CreatedAt == nil {
+			continue
+		}
+		hours := comment.CreatedAt.Sub(opened).Hours()
+		if hours < 0 {
+			hours = 0
+		}
+		for _, emoji := range emojis(comment.String()) {
+			if !disabled[emoji] && !voting(emoji) {
+				score += 1 / (1 + hours)
+			}
+		}
+	}
+	return score
+}
+
+// status renders a new status report of a tally in the requested format. Apart
+// from the tally, it only depends on the configuration and the current time, not
+// touching GitHub in any way.
+func status(f format, t *tally) string {
 	report := ""
+	if f == markdown {
+		report = summaryMarker + "\n\n"
+	}
 
-	// Issues any warning if requested
-	if len(warning) > 0 {
-		report += ":exclamation: " + warning + " :exclamation:\n\n"
+	// Link back to the pull request if requested
+	if linkHeader && t.Link != "" {
+		report += f.emphasis("Review tally of "+t.Link) + "\n\n"
+	}
+	// Issues any warnings if requested, each on its own line
+	for _, warning := range t.Warnings {
+		report += f.warning(warning) + "\n\n"
 	}
 	// Collect the number of upvotes and downvotes
-	up, down := []string{}, []string{}
-	for user, yes := range votes {
-		if yes {
-			up = append(up, "@"+user)
+	up, down := split(t.Votes, t.Muted)
+	switch {
+	case t.Final == "Merged":
+		report += f.strong(fmt.Sprintf("Merged with %d approvals", len(up))) + "\n\n"
+	case t.Final != "":
+		report += f.strong(t.Final) + "\n\n"
+	}
+	if state := agreement(len(up), len(down)); state != "" {
+		report += f.emphasis("Review state: "+state) + "\n\n"
+	}
+	// Generate the review statistics
+	rows := [][]string{
+		{upvoteEmoji, strconv.Itoa(len(up)), strings.Join(up, " ")},
+		{downvoteEmoji, strconv.Itoa(len(down)), strings.Join(down, " ")},
+	}
+	// Append the votes of users below the minimum role, if any
+	if len(t.Advisory) > 0 {
+		up, down := split(t.Advisory, t.Muted)
+		rows = append(rows,
+			[]string{upvoteEmoji + " (advisory)", strconv.Itoa(len(up)), strings.Join(up, " ")},
+			[]string{downvoteEmoji + " (advisory)", strconv.Itoa(len(down)), strings.Join(down, " ")},
+		)
+	}
+	// Append the votes that expired out of the freshness window, if any
+	if len(t.Stale) > 0 {
+		up, down := split(t.Stale, t.Muted)
+		rows = append(rows,
+			[]string{upvoteEmoji + " (stale)", strconv.Itoa(len(up)), strings.Join(up, " ")},
+			[]string{downvoteEmoji + " (stale)", strconv.Itoa(len(down)), strings.Join(down, " ")},
+		)
+	}
+	// Append the roster of testers if tracked separately
+	if testedEmoji != "" {
+		testers := []string{}
+		for user := range t.Reactions[testedEmoji] {
+			testers = append(testers, mention(user, t.Muted))
+		}
+		sortMentions(testers)
+		rows = append(rows, []string{testedEmoji, strconv.Itoa(len(testers)), strings.Join(testers, " ")})
+	}
+	report += f.table([]string{"Vote", "Count", "Reviewers"}, rows)
+
+	// Report the approvals of the requested reviewers if thresholds are relative
+	approved, need := approvals(t)
+	if reviewerRatio > 0 {
+		report += "\n\n" + f.emphasis(fmt.Sprintf("%d/%d reviewers approved (need %d)", approved, len(t.Reviewers), need))
+	}
+	// Visualize the progress toward the approval threshold if requested
+	if progressBar {
+		done, total := len(up)-len(down), threshold
+		if consensus {
+			done = len(up)
+		}
+		if reviewerRatio > 0 {
+			done, total = approved, need
+		}
+		if total > 0 {
+			report += "\n\n" + f.progress(done, total)
+		}
+	}
+	// Show the soft score of the weighted reactions next to the hard counts
+	if len(softWeights) > 0 {
+		report += "\n\n" + f.emphasis(fmt.Sprintf("Soft score: %.2f", t.Soft))
+	}
+	// Surface any unmet conditions if consensus is required, or missing team approvals
+	if !consensus && len(t.Missing) > 0 {
+		report += "\n\n" + f.emphasis("Approval needed from "+strings.Join(t.Missing, " "))
+	}
+	if consensus {
+		if _, unmet := conclusion(t); len(unmet) > 0 {
+			report += "\n\n" + f.emphasis("Consensus not reached: "+strings.Join(unmet, ", "))
 		} else {
-			down = append(down, "@"+user)
+			report += "\n\n" + f.emphasis("Consensus reached")
 		}
 	}
-	// Sort the users and generate the review statistics
-	sort.Strings(up)
-	sort.Strings(down)
+	// Combine the votes from all linked pull requests, labeled by source
+	if len(t.Linked) > 0 {
+		sources := []int{}
+		for number := range t.Linked {
+			sources = append(sources, number)
+		}
+		sort.Ints(sources)
+
+		// Count every user once across sources, their vote on this PR taking precedence
+		combined := make(map[string]bool)
+		for user, yes := range t.Votes {
+			combined[user] = yes
+		}
+		up, down := split(t.Votes, t.Muted)
+		rows := [][]string{{"This PR", voters(up), voters(down)}}
 
-	report += fmt.Sprintf("| Vote | Count | Reviewers |\n| :---: | :---: | :---: |\n| :+1: | %d | %s |\n| :-1: | %d | %s |",
-		len(up), strings.Join(up, " "), len(down), strings.Join(down, " "))
+		for _, number := range sources {
+			up, down := split(t.Linked[number], t.Muted)
+			rows = append(rows, []string{fmt.Sprintf("#%d", number), voters(up), voters(down)})
 
+			for user, yes := range t.Linked[number] {
+				if _, ok := combined[user]; !ok {
+					combined[user] = yes
+				}
+			}
+		}
+		up, down = split(combined, t.Muted)
+		rows = append(rows, []string{"Combined", voters(up), voters(down)})
+		report += "\n\n" + f.table([]string{"Source", upvoteEmoji, downvoteEmoji}, rows)
+	}
+	// Report the agreement with inline review comments and linked discussions
+	// separately from the votes, neither being binding
+	if reacted(t.Inline) {
+		report += "\n\n" + f.strong("Inline agreement") + "\n\n" + agreementTable(f, t.Inline, t.Muted)
+	}
+	if reacted(t.Forum) {
+		report += "\n\n" + f.strong("Discussion reactions (advisory)") + "\n\n" + agreementTable(f, t.Forum, t.Muted)
+	}
+	if t.Degraded {
+		report += "\n\n" + f.emphasis("Reactions unavailable, tallied comments only")
+	}
 	// If there were additionally requested emojis, report on them too
-	if len(emojis) > 0 {
+	var (
+		table     string
+		overflow  string
+		ordered   []string
+		reactions = make(map[string][]string)
+	)
+	if reactionTable && len(t.Reactions) > 0 {
 		// Gather the reactions and assotiated users
-		reactions := make(map[string][]string)
-		for emoji, users := range emojis {
+		for emoji, users := range t.Reactions {
+			if emoji == testedEmoji {
+				continue
+			}
 			for user := range users {
-				reactions[emoji] = append(reactions[emoji], "@"+user)
+				reactions[emoji] = append(reactions[emoji], mention(user, t.Muted))
 			}
-			sort.Strings(reactions[emoji])
+			sortMentions(reactions[emoji])
 		}
-		// Order the reactions by frequency
+		// Order the reactions by priority first, frequency second
 		emojis := make([]string, 0, len(reactions))
 		for emoji := range reactions {
 			emojis = append(emojis, emoji)
 		}
-		for i, first := range emojis {
-			for j, second := range emojis[i+1:] {
-				if len(reactions[first]) < len(reactions[second]) {
-					emojis[i], emojis[j] = emojis[j], emojis[i]
-					first, second = second, first
-				}
+		sort.Strings(emojis)
+
+		rank := make(map[string]int)
+		for i, emoji := range reactionPriority {
+			if _, ok := rank[emoji]; !ok {
+				rank[emoji] = len(reactionPriority) - i
 			}
 		}
+		sort.SliceStable(emojis, func(i, j int) bool {
+			if rank[emojis[i]] != rank[emojis[j]] {
+				return rank[emojis[i]] > rank[emojis[j]]
+			}
+			return len(reactions[emojis[i]]) > len(reactions[emojis[j]])
+		})
+		// Cap the number of rows, summarizing the least popular reactions
+		if reactionRows > 0 && len(emojis) > reactionRows {
+			overflow = "\n\n" + f.emphasis(fmt.Sprintf("+%d more reactions", len(emojis)-reactionRows))
+			emojis = emojis[:reactionRows]
+		}
 		// Generate a report for the reactions too
-		report += fmt.Sprintf("\n\n| Reaction | Users |\n| :---: | :---: |\n")
+		if ordered = emojis; len(ordered) > 0 {
+			table = "\n\n" + reactionsTable(f, ordered, reactions, false) + overflow
+		}
+	}
+	// Note any automated actions taken on the pull request for accountability
+	footer := ""
+	for _, note := range t.Audit {
+		footer += "\n\n" + f.emphasis("Robotally: "+note)
+	}
+	// Note the urgency of the reactions if requested
+	if urgencyScore {
+		footer += "\n\n" + f.emphasis(fmt.Sprintf("Urgency score: %.2f", t.Score))
+	}
+	// Add the tallied commit and modification time
+	commit := t.Commit
+	if len(commit) > 7 {
+		commit = commit[:7]
+	}
+	if commit != "" {
+		footer += "\n\n" + f.emphasis("Tally at commit "+commit)
+	}
+	closing := new(bytes.Buffer)
+	if err := footerLine.Execute(closing, struct{ Updated time.Time }{now().UTC()}); err == nil && closing.Len() > 0 {
+		if f == markdown {
+			footer += "\n\n" + footerMarker
+		}
+		footer += "\n\n" + f.emphasis(closing.String())
+	}
+
+	// Collapse the reactions table if the report would exceed GitHub's size limit
+	if len(report)+len(table)+len(footer) > maxReportSize && table != "" {
+		table = "\n\n" + reactionsTable(f, ordered, reactions, true) + overflow
+		if len(report)+len(table)+len(footer) > maxReportSize {
+			table = "\n\n" + f.emphasis("Reactions omitted, too many to list")
+		}
+	}
+	return report + table + footer
+}
+
+// reacted reports whether any user reacted with any of the given emojis.
+func reacted(reactions map[string]map[string]struct{}) bool {
+	for _, users := range reactions {
+		if len(users) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// agreementTable renders the table of users reacting with the vote emojis on
+// something other than the pull request itself.
+func agreementTable(f format, reactions map[string]map[string]struct{}, muted map[string]bool) string {
+	rows := [][]string{}
+	for _, emoji := range []string{upvoteEmoji, downvoteEmoji} {
+		users := []string{}
+		for user := range reactions[emoji] {
+			users = append(users, mention(user, muted))
+		}
+		sortMentions(users)
+		rows = append(rows, []string{emoji, strconv.Itoa(len(users)), strings.Join(users, " ")})
+	}
+	return f.table([]string{"Reaction", "Count", "Users"}, rows)
+}
+
+// voters renders a list of voters as their count followed by their mentions.
+func voters(mentions []string) string {
+	return strings.TrimSpace(strconv.Itoa(len(mentions)) + " " + strings.Join(mentions, " "))
+}
+
+// split separates a set of votes into the sorted lists of up and down voters,
+// rendered as mentions.
+func split(votes map[string]bool, muted map[string]bool) ([]string, []string) {
+	up, down := []string{}, []string{}
+	for user, yes := range votes {
+		if yes {
+			up = append(up, mention(user, muted))
+		} else {
+			down = append(down, mention(user, muted))
+		}
+	}
+	sortMentions(up)
+	sortMentions(down)
+
+	return up, down
+}
+
+// reactionsTable renders the table of emoji reactions in the given order, grouped
+// by category if configured, along with the number of users reacting. In compact
+// mode only the count is shown instead of listing all of the users.
+func reactionsTable(f format, emojis []string, reactions map[string][]string, compact bool) string {
+	row := func(emoji string) []string {
+		if compact {
+			return []string{emoji, strconv.Itoa(len(reactions[emoji])), ""}
+		}
+		return []string{emoji, strconv.Itoa(len(reactions[emoji])), strings.Join(reactions[emoji], " ")}
+	}
+	var rows [][]string
+	if len(reactionGroups) == 0 {
 		for _, emoji := range emojis {
-			report += fmt.Sprintf("| %s | %s |\n", emoji, strings.Join(reactions[emoji], " "))
+			rows = append(rows, row(emoji))
 		}
+		return f.table([]string{"Reaction", "Count", "Users"}, rows)
+	}
+	grouped := make(map[string]bool)
+	for _, group := range reactionGroups {
+		// Gather the present emojis of the group, retaining frequency order
+		members := make(map[string]bool)
+		for _, emoji := range group.Emojis {
+			members[emoji] = true
+		}
+		var section [][]string
+		for _, emoji := range emojis {
+			if members[emoji] && !grouped[emoji] {
+				section = append(section, row(emoji))
+				grouped[emoji] = true
+			}
+		}
+		if len(section) > 0 {
+			rows = append(append(rows, []string{f.strong(group.Name), "", ""}), section...)
+		}
+	}
+	// Render all the remaining emojis in a default section
+	var section [][]string
+	for _, emoji := range emojis {
+		if !grouped[emoji] {
+			section = append(section, row(emoji))
+		}
+	}
+	if len(section) > 0 {
+		rows = append(append(rows, []string{f.strong("Other"), "", ""}), section...)
 	}
-	// Add the modification time and return
-	return report + fmt.Sprintf("\n\n_Updated: %s_", time.Now().UTC().Format("Mon Jan 2 15:04:05 MST 2006"))
+	return f.table([]string{"Reaction", "Count", "Users"}, rows)
 }
@@ -0,0 +1,1533 @@
+package robotally
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"text/template"
+	"time"
+
+	"github.com/google/go-github/github"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/aetest"
+)
+
+// newTestAPI starts a fake API server, serving the given routes keyed by method
+// and path (e.g. "GET /repos/owner/repo/pulls/1"). Requests to unknown routes
+// fail the test.
+func newTestAPI(t *testing.T, routes map[string]http.HandlerFunc) *httptest.Server {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		route, ok := routes[r.Method+" "+r.URL.Path]
+		if !ok {
+			t.Errorf("unexpected API call: %s %s", r.Method, r.URL.Path)
+			http.Error(w, `{"message": "Not Found"}`, http.StatusNotFound)
+			return
+		}
+		route(w, r)
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+// newTestClient creates a GitHub client backed by a fake API server serving the
+// given routes.
+func newTestClient(t *testing.T, routes map[string]http.HandlerFunc) *github.Client {
+	client := github.NewClient(nil)
+	client.BaseURL, _ = url.Parse(newTestAPI(t, routes).URL + "/")
+	return client
+}
+
+// useTestAPI points the GitHub clients created by the handlers to a fake API
+// server serving the given routes, for the duration of the test.
+func useTestAPI(t *testing.T, routes map[string]http.HandlerFunc) {
+	old := githubURL
+	t.Cleanup(func() { githubURL = old })
+
+	githubURL = newTestAPI(t, routes).URL + "/"
+}
+
+// deliver posts a webhook event to the handler, returning the recorded response.
+func deliver(t *testing.T, event *Event) *httptest.ResponseRecorder {
+	body, err := json.Marshal(event)
+	if err != nil {
+		t.Fatalf("failed to encode event: %v", err)
+	}
+	req := newRequest(t, "POST", "/", bytes.NewReader(body))
+	req.Header.Set("X-GitHub-Event", "pull_request")
+
+	rec := httptest.NewRecorder()
+	handler(rec, req)
+	return rec
+}
+
+// testRepo is the repository the webhook events of the tests originate from.
+var testRepo = &Repository{Name: "repo", FullName: "owner/repo", Owner: &User{Login: "owner"}}
+
+// reply responds to a fake API call with the JSON encoding of a value.
+func reply(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+// replyPages responds to a fake API call with the requested page out of a set,
+// linking to the next one the same way GitHub does.
+func replyPages(w http.ResponseWriter, r *http.Request, pages ...interface{}) {
+	page, _ := strconv.Atoi(r.URL.Query().Get("page"))
+	if page < 1 {
+		page = 1
+	}
+	if page < len(pages) {
+		next := *r.URL
+		query := next.Query()
+		query.Set("page", strconv.Itoa(page+1))
+		next.RawQuery = query.Encode()
+		w.Header().Set("Link", fmt.Sprintf(`<http://%s%s>; rel="next"`, r.Host, next.String()))
+	}
+	if page > len(pages) {
+		reply(w, []interface{}{})
+		return
+	}
+	reply(w, pages[page-1])
+}
+
+// newComment creates an issue comment by a user, created at the given offset
+// from a fixed reference time.
+func newComment(id int, user string, body string, offset time.Duration) *github.IssueComment {
+	created := testTime.Add(offset)
+	return &github.IssueComment{
+		ID:        github.Int(id),
+		Body:      github.String(body),
+		User:      &github.User{Login: github.String(user)},
+		CreatedAt: &created,
+	}
+}
+
+// testTime is the fixed reference time tests are run at.
+var testTime = time.Date(2020, time.March, 1, 12, 0, 0, 0, time.UTC)
+
+// Tests that votes cast while a pull request was a draft are ignored, even if
+// the event marking it ready for review is on a later page.
+func TestReadySinceExcludesDraftVotes(t *testing.T) {
+	ready := testTime.Add(time.Hour)
+	client := newTestClient(t, map[string]http.HandlerFunc{
+		"GET /repos/owner/repo/pulls/1": func(w http.ResponseWriter, r *http.Request) {
+			reply(w, map[string]interface{}{"number": 1, "draft": false})
+		},
+		"GET /repos/owner/repo/issues/1/events": func(w http.ResponseWriter, r *http.Request) {
+			replyPages(w, r,
+				[]*github.IssueEvent{{Event: github.String("labeled"), CreatedAt: &testTime}, {Event: github.String("ready_for_review")}},
+				[]*github.IssueEvent{{Event: github.String("ready_for_review"), CreatedAt: &ready}},
+			)
+		},
+	})
+	since, err := readySince(client, "owner", "repo", 1)
+	if err != nil {
+		t.Fatalf("failed to resolve ready time: %v", err)
+	}
+	if !since.Equal(ready) {
+		t.Fatalf("ready time mismatch: have %v, want %v", since, ready)
+	}
+	comments := []*github.IssueComment{
+		newComment(1, "alice", ":+1:", 30*time.Minute),
+		newComment(2, "bob", ":-1:", 90*time.Minute),
+	}
+	votes, _, _ := aggregate(comments, nil, since, nil, nil, nil)
+	if _, ok := votes["alice"]; ok {
+		t.Errorf("draft vote counted: %v", votes)
+	}
+	if yes, ok := votes["bob"]; !ok || yes {
+		t.Errorf("ready vote missing: %v", votes)
+	}
+}
+
+// Tests that pull requests still in draft don't count any votes yet.
+func TestReadySinceInDraft(t *testing.T) {
+	defer func(old func() time.Time) { now = old }(now)
+	now = func() time.Time { return testTime }
+
+	client := newTestClient(t, map[string]http.HandlerFunc{
+		"GET /repos/owner/repo/pulls/1": func(w http.ResponseWriter, r *http.Request) {
+			if accept := r.Header.Get("Accept"); accept != "application/vnd.github.shadow-cat-preview+json" {
+				t.Errorf("draft preview not requested: %s", accept)
+			}
+			reply(w, map[string]interface{}{"number": 1, "draft": true})
+		},
+	})
+	since, err := readySince(client, "owner", "repo", 1)
+	if err != nil {
+		t.Fatalf("failed to resolve ready time: %v", err)
+	}
+	if !since.Equal(testTime) {
+		t.Fatalf("ready time mismatch: have %v, want %v", since, testTime)
+	}
+}
+
+// Tests that testers are listed on their own row and that approval waits for one
+// if testing is required.
+func TestTesterRoster(t *testing.T) {
+	defer func(emoji string, required bool) { testedEmoji, testedRequired = emoji, required }(testedEmoji, testedRequired)
+	testedEmoji, testedRequired = ":rocket:", true
+
+	comments := []*github.IssueComment{
+		newComment(1, "alice", ":+1:", 0),
+		newComment(2, "bob", ":+1:", time.Minute),
+	}
+	votes, _, reactions := aggregate(comments, nil, time.Time{}, nil, nil, nil)
+
+	untested := &tally{Votes: votes, Reactions: reactions}
+	if report := status(markdown, untested); !strings.Contains(report, "| :rocket: | 0 |  |") {
+		t.Errorf("empty tester row missing:\n%s", report)
+	}
+	if result, unmet := conclusion(untested); result != "neutral" || !reflect.DeepEqual(unmet, []string{"not tested yet"}) {
+		t.Errorf("untested conclusion mismatch: have %s %v, want neutral [not tested yet]", result, unmet)
+	}
+	comments = append(comments, newComment(3, "carol", "Works for me :rocket:", 2*time.Minute))
+	votes, _, reactions = aggregate(comments, nil, time.Time{}, nil, nil, nil)
+
+	tested := &tally{Votes: votes, Reactions: reactions}
+	if report := status(markdown, tested); !strings.Contains(report, "| :rocket: | 1 | @carol |") {
+		t.Errorf("tester row missing:\n%s", report)
+	}
+	if result, unmet := conclusion(tested); result != "success" || len(unmet) != 0 {
+		t.Errorf("tested conclusion mismatch: have %s %v, want success", result, unmet)
+	}
+}
+
+var (
+	instance     aetest.Instance // Development server shared by the tests needing one
+	instanceErr  error           // Failure starting the development server, if any
+	instanceOnce sync.Once       // Guard starting the development server only once
+)
+
+// TestMain runs the tests, shutting down the shared development server if any
+// of them started it.
+func TestMain(m *testing.M) {
+	code := m.Run()
+	if instance != nil {
+		instance.Close()
+	}
+	os.Exit(code)
+}
+
+// newRequest creates an HTTP request whose App Engine context is backed by the
+// shared development server, skipping the test if the App Engine SDK is not
+// installed.
+func newRequest(t *testing.T, method, url string, body io.Reader) *http.Request {
+	instanceOnce.Do(func() {
+		instance, instanceErr = aetest.NewInstance(&aetest.Options{StronglyConsistentDatastore: true, SuppressDevAppServerLog: true})
+	})
+	if instanceErr != nil {
+		t.Skipf("App Engine development server unavailable: %v", instanceErr)
+	}
+	req, err := instance.NewRequest(method, url, body)
+	if err != nil {
+		t.Fatalf("failed to create request: %v", err)
+	}
+	return req
+}
+
+// newContext creates an App Engine context backed by the shared development
+// server, skipping the test if the App Engine SDK is not installed.
+func newContext(t *testing.T) context.Context {
+	return appengine.NewContext(newRequest(t, "GET", "/", nil))
+}
+
+// Tests that the reactions table can be disabled, even with reactions present.
+func TestReactionTableDisabled(t *testing.T) {
+	comments := []*github.IssueComment{newComment(1, "alice", ":+1: :tada:", 0)}
+	if _, _, reactions := aggregate(comments, nil, time.Time{}, nil, nil, nil); len(reactions[":tada:"]) != 1 {
+		t.Fatalf("reaction missing with the table enabled: %v", reactions)
+	}
+	if report := status(markdown, &tally{Reactions: map[string]map[string]struct{}{":tada:": {"alice": {}}}}); !strings.Contains(report, "| :tada: |") {
+		t.Fatalf("reactions table missing with the table enabled:\n%s", report)
+	}
+	defer func(old bool) { reactionTable = old }(reactionTable)
+	reactionTable = false
+
+	votes, _, reactions := aggregate(comments, nil, time.Time{}, nil, nil, nil)
+	if len(reactions) != 0 {
+		t.Errorf("reactions gathered with the table disabled: %v", reactions)
+	}
+	report := status(markdown, &tally{Votes: votes, Reactions: map[string]map[string]struct{}{":tada:": {"alice": {}}}})
+	if strings.Contains(report, "Reaction") || strings.Contains(report, ":tada:") {
+		t.Errorf("reactions table rendered with the table disabled:\n%s", report)
+	}
+}
+
+// Tests that the footer notes the abbreviated commit the tally was made at.
+func TestCommitFooter(t *testing.T) {
+	report := status(markdown, &tally{Commit: "0123456789abcdef0123456789abcdef01234567"})
+	if !strings.Contains(report, "_Tally at commit 0123456_") {
+		t.Errorf("tallied commit missing:\n%s", report)
+	}
+	if strings.Contains(report, "01234567") {
+		t.Errorf("tallied commit not abbreviated:\n%s", report)
+	}
+	if report := status(markdown, &tally{}); strings.Contains(report, "Tally at commit") {
+		t.Errorf("tallied commit reported without one:\n%s", report)
+	}
+}
+
+// Tests that closing a pull request deletes its report if configured to, while
+// keeping the stored record around.
+func TestDeleteOnClose(t *testing.T) {
+	defer func(old bool) { deleteOnClose = old }(deleteOnClose)
+	deleteOnClose = true
+
+	deleted := false
+	useTestAPI(t, map[string]http.HandlerFunc{
+		"DELETE /repos/owner/repo/issues/comments/77": func(w http.ResponseWriter, r *http.Request) {
+			deleted = true
+			w.WriteHeader(http.StatusNoContent)
+		},
+	})
+	ctx := newContext(t)
+	if err := saveRecord(ctx, "owner/repo", 329, 77, "sha", "report"); err != nil {
+		t.Fatalf("failed to store record: %v", err)
+	}
+	rec := deliver(t, &Event{Action: "closed", Repository: testRepo, PullRequest: &PullRequest{Number: 329}})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("close failed: %d %s", rec.Code, rec.Body)
+	}
+	if !deleted {
+		t.Errorf("report not deleted")
+	}
+	record, err := loadRecord(ctx, "owner/repo", 329)
+	if err != nil {
+		t.Fatalf("failed to load record: %v", err)
+	}
+	if record.CommentID != 0 || record.Report != "report" {
+		t.Errorf("record mismatch after deletion: %+v", record)
+	}
+}
+
+// Tests that early reactions weigh more toward the urgency score than late ones.
+func TestUrgency(t *testing.T) {
+	early := urgency([]*github.IssueComment{newComment(1, "alice", ":tada:", 0)}, testTime)
+	late := urgency([]*github.IssueComment{newComment(1, "alice", ":tada:", 3*time.Hour)}, testTime)
+	if early != 1 {
+		t.Errorf("early urgency mismatch: have %v, want %v", early, 1.0)
+	}
+	if late != 0.25 {
+		t.Errorf("late urgency mismatch: have %v, want %v", late, 0.25)
+	}
+	// Votes and the bot's own comments don't count toward the urgency
+	if score := urgency([]*github.IssueComment{newComment(1, "alice", ":+1:", 0), newComment(2, githubUser, ":tada:", 0)}, testTime); score != 0 {
+		t.Errorf("non-reaction urgency mismatch: have %v, want %v", score, 0.0)
+	}
+}
+
+// fakePR is a pull request served by the fake GitHub API, tracking the changes
+// made to its comments.
+type fakePR struct {
+	Number   int
+	Author   string
+	Base     string
+	Comments []*github.IssueComment
+
+	Created []string       // Bodies of the comments posted
+	Edited  map[int]string // Latest bodies of the comments edited
+	Edits   int            // Number of comment edits made
+	Deleted []int          // Identifiers of the comments deleted
+
+	routes map[string]http.HandlerFunc // Routes to extend with the created comments
+	lock   sync.Mutex
+}
+
+// install adds the API routes serving the pull request to a route set.
+func (pr *fakePR) install(routes map[string]http.HandlerFunc) map[string]http.HandlerFunc {
+	pr.routes = routes
+
+	prefix := fmt.Sprintf("/repos/owner/repo/issues/%d", pr.Number)
+	routes["GET "+prefix+"/comments"] = func(w http.ResponseWriter, r *http.Request) {
+		pr.lock.Lock()
+		defer pr.lock.Unlock()
+		reply(w, pr.Comments)
+	}
+	routes["POST "+prefix+"/comments"] = func(w http.ResponseWriter, r *http.Request) {
+		pr.lock.Lock()
+		defer pr.lock.Unlock()
+
+		comment := new(github.IssueComment)
+		json.NewDecoder(r.Body).Decode(comment)
+		comment.ID, comment.User = github.Int(10000*pr.Number+len(pr.Created)), &github.User{Login: github.String(githubUser)}
+
+		pr.Created = append(pr.Created, *comment.Body)
+		pr.Comments = append(pr.Comments, comment)
+		pr.installComment(pr.routes, *comment.ID)
+		reply(w, comment)
+	}
+	routes[fmt.Sprintf("GET /repos/owner/repo/pulls/%d", pr.Number)] = func(w http.ResponseWriter, r *http.Request) {
+		base := pr.Base
+		if base == "" {
+			base = "dev"
+		}
+		reply(w, &github.PullRequest{
+			Number:    github.Int(pr.Number),
+			User:      &github.User{Login: github.String(pr.Author)},
+			HTMLURL:   github.String(fmt.Sprintf("https://github.com/owner/repo/pull/%d", pr.Number)),
+			CreatedAt: &testTime,
+			Head:      &github.PullRequestBranch{SHA: github.String("0123456789abcdef")},
+			Base:      &github.PullRequestBranch{Ref: github.String(base)},
+		})
+	}
+	for _, comment := range pr.Comments {
+		pr.installComment(routes, *comment.ID)
+	}
+	return routes
+}
+
+// installComment adds the API routes editing and deleting a comment.
+func (pr *fakePR) installComment(routes map[string]http.HandlerFunc, id int) {
+	path := fmt.Sprintf("/repos/owner/repo/issues/comments/%d", id)
+	routes["PATCH "+path] = func(w http.ResponseWriter, r *http.Request) {
+		pr.lock.Lock()
+		defer pr.lock.Unlock()
+
+		edit := new(github.IssueComment)
+		json.NewDecoder(r.Body).Decode(edit)
+		for _, comment := range pr.Comments {
+			if *comment.ID == id {
+				if pr.Edited == nil {
+					pr.Edited = make(map[int]string)
+				}
+				comment.Body, pr.Edited[id] = edit.Body, *edit.Body
+				pr.Edits++
+				reply(w, comment)
+				return
+			}
+		}
+		http.Error(w, `{"message": "Not Found"}`, http.StatusNotFound)
+	}
+	routes["DELETE "+path] = func(w http.ResponseWriter, r *http.Request) {
+		pr.lock.Lock()
+		defer pr.lock.Unlock()
+
+		for i, comment := range pr.Comments {
+			if *comment.ID == id {
+				pr.Comments = append(pr.Comments[:i], pr.Comments[i+1:]...)
+				pr.Deleted = append(pr.Deleted, id)
+				w.WriteHeader(http.StatusNoContent)
+				return
+			}
+		}
+		http.Error(w, `{"message": "Not Found"}`, http.StatusNotFound)
+	}
+}
+
+// Tests that users who muted notifications are listed without an @mention, and
+// that the preference survives a round trip through the datastore.
+func TestMutedMentions(t *testing.T) {
+	if mute, ok := muteCommand("thanks\n/tally mute\n"); !ok || !mute {
+		t.Fatalf("mute command not recognized: %v %v", mute, ok)
+	}
+	ctx := newContext(t)
+	if err := savePreference(ctx, "alice", true); err != nil {
+		t.Fatalf("failed to store preference: %v", err)
+	}
+	defer savePreference(ctx, "alice", false)
+
+	if err := savePreference(ctx, "carol", false); err != nil {
+		t.Fatalf("failed to store preference: %v", err)
+	}
+	muted, err := mutedUsers(ctx)
+	if err != nil {
+		t.Fatalf("failed to load preferences: %v", err)
+	}
+	if want := map[string]bool{"alice": true}; !reflect.DeepEqual(muted, want) {
+		t.Fatalf("muted users mismatch: have %v, want %v", muted, want)
+	}
+	report := status(markdown, &tally{Votes: map[string]bool{"alice": true, "bob": true, "carol": false}, Muted: muted})
+	if !strings.Contains(report, "| :+1: | 2 | alice @bob |") {
+		t.Errorf("muted user mentioned in upvotes:\n%s", report)
+	}
+	if !strings.Contains(report, "| :-1: | 1 | @carol |") {
+		t.Errorf("unmuted user not mentioned in downvotes:\n%s", report)
+	}
+}
+
+// Tests that the vote emojis can be remapped, the tally and the report following
+// the configured ones.
+func TestCustomVoteEmoji(t *testing.T) {
+	defer func(up, down string) { upvoteEmoji, downvoteEmoji = up, down }(upvoteEmoji, downvoteEmoji)
+	upvoteEmoji, downvoteEmoji = ":white_check_mark:", ":x:"
+
+	comments := []*github.IssueComment{
+		newComment(1, "alice", "LGTM :white_check_mark:", 0),
+		newComment(2, "bob", ":x: needs work", time.Minute),
+		newComment(3, "carol", ":heart:", 2*time.Minute),
+	}
+	votes, _, reactions := aggregate(comments, nil, time.Time{}, nil, nil, nil)
+	if want := map[string]bool{"alice": true, "bob": false}; !reflect.DeepEqual(votes, want) {
+		t.Errorf("votes mismatch: have %v, want %v", votes, want)
+	}
+	if _, ok := reactions[":white_check_mark:"]; ok {
+		t.Errorf("vote emoji listed as reaction")
+	}
+	report := status(markdown, &tally{Votes: votes, Reactions: reactions})
+	for _, row := range []string{"| :white_check_mark: | 1 | @alice |", "| :x: | 1 | @bob |", "| :heart: | 1 | @carol |"} {
+		if !strings.Contains(report, row) {
+			t.Errorf("report row %q missing:\n%s", row, report)
+		}
+	}
+}
+
+// Tests that applying the required label starts tallying, creating the report,
+// while other labels leave the pull request alone.
+func TestRequiredLabelCreatesReport(t *testing.T) {
+	defer func(old string) { requiredLabel = old }(requiredLabel)
+	requiredLabel = "needs-votes"
+
+	pr := &fakePR{Number: 333, Author: "author", Comments: []*github.IssueComment{
+		newComment(1, "alice", ":+1:", 0),
+	}}
+	useTestAPI(t, pr.install(make(map[string]http.HandlerFunc)))
+
+	opened := deliver(t, &Event{Action: "opened", Repository: testRepo, PullRequest: &PullRequest{Number: 333, User: &User{Login: "author"}}})
+	if opened.Code != http.StatusOK || len(pr.Created) != 0 {
+		t.Fatalf("ungated pull request tallied: %d, %d reports", opened.Code, len(pr.Created))
+	}
+	other := deliver(t, &Event{Action: "labeled", Repository: testRepo, Label: &Label{Name: "bug"}, PullRequest: &PullRequest{
+		Number: 333, Labels: []*Label{{Name: "bug"}},
+	}})
+	if other.Code != http.StatusOK || len(pr.Created) != 0 {
+		t.Fatalf("unrelated label started tallying: %d, %d reports", other.Code, len(pr.Created))
+	}
+	gated := deliver(t, &Event{Action: "labeled", Repository: testRepo, Label: &Label{Name: "needs-votes"}, PullRequest: &PullRequest{
+		Number: 333, Labels: []*Label{{Name: "bug"}, {Name: "needs-votes"}},
+	}})
+	if gated.Code != http.StatusOK {
+		t.Fatalf("labeling failed: %d %s", gated.Code, gated.Body)
+	}
+	if len(pr.Created) != 1 || !strings.Contains(pr.Created[0], "| :+1: | 1 | @alice |") {
+		t.Errorf("report not created on labeling: %v", pr.Created)
+	}
+}
+
+// Tests that the votes on a fork pull request only count from the intended
+// author associations, the fork's contributors being left out.
+func TestForkVoteAssociations(t *testing.T) {
+	defer func(old map[string]bool) { voterAssociations = old }(voterAssociations)
+	voterAssociations = map[string]bool{"OWNER": true, "MEMBER": true, "COLLABORATOR": true}
+
+	client := newTestClient(t, map[string]http.HandlerFunc{
+		"GET /repos/owner/repo/issues/333/comments": func(w http.ResponseWriter, r *http.Request) {
+			reply(w, []map[string]interface{}{
+				{"id": 1, "user": map[string]string{"login": "forker"}, "body": ":+1:", "author_association": "CONTRIBUTOR"},
+				{"id": 2, "user": map[string]string{"login": "member"}, "body": ":-1:", "author_association": "MEMBER"},
+				{"id": 3, "user": map[string]string{"login": "owner"}, "body": ":+1: :tada:", "author_association": "OWNER"},
+				{"id": 4, "user": map[string]string{"login": "drive-by"}, "body": ":+1: :tada:", "author_association": "NONE"},
+			})
+		},
+	})
+	comments, associations, err := listComments(client, "owner", "repo", 333)
+	if err != nil {
+		t.Fatalf("failed to list comments: %v", err)
+	}
+	votes, _, reactions := aggregate(comments, associations, time.Time{}, nil, nil, nil)
+	if want := map[string]bool{"member": false, "owner": true}; !reflect.DeepEqual(votes, want) {
+		t.Errorf("votes mismatch: have %v, want %v", votes, want)
+	}
+	// Reactions aren't votes, they're still shown from everyone
+	if len(reactions[":tada:"]) != 2 {
+		t.Errorf("reaction count mismatch: have %d, want %d", len(reactions[":tada:"]), 2)
+	}
+}
+
+// Tests that an opted out pull request is skipped until the opt-out label is
+// removed, even if it's removed while the required label is missing too.
+func TestOptOutLabel(t *testing.T) {
+	defer func(old string) { requiredLabel = old }(requiredLabel)
+	requiredLabel = "needs-votes"
+
+	pr := &fakePR{Number: 334, Author: "author", Comments: []*github.IssueComment{
+		newComment(1, githubUser, summaryMarker+"\n\nreport", 0),
+		newComment(2, "alice", ":+1:", time.Minute),
+	}}
+	useTestAPI(t, pr.install(make(map[string]http.HandlerFunc)))
+
+	labeled := func(action, label string, labels ...string) {
+		event := &Event{Action: action, Repository: testRepo, Label: &Label{Name: label}, PullRequest: &PullRequest{Number: 334}}
+		for _, name := range labels {
+			event.PullRequest.Labels = append(event.PullRequest.Labels, &Label{Name: name})
+		}
+		if rec := deliver(t, event); rec.Code != http.StatusOK {
+			t.Fatalf("%s %s failed: %d %s", action, label, rec.Code, rec.Body)
+		}
+	}
+	// Opt out and ensure the report is removed and not refreshed any more
+	labeled("labeled", "no-tally", "needs-votes", "no-tally")
+	if len(pr.Deleted) != 1 {
+		t.Fatalf("report not deleted on opt-out: %v", pr.Deleted)
+	}
+	ctx := newContext(t)
+	if _, err := refresh(ctx, newClient(ctx), "owner", "repo", 334, true, true); err != nil {
+		t.Fatalf("failed to refresh: %v", err)
+	}
+	if len(pr.Created) != 0 || len(pr.Edited) != 0 {
+		t.Fatalf("opted out pull request tallied: created %v, edited %v", pr.Created, pr.Edited)
+	}
+	// Drop both labels, opt-out last, then gate the PR back in
+	labeled("unlabeled", "needs-votes", "no-tally")
+	labeled("unlabeled", "no-tally")
+	if len(pr.Created) != 0 {
+		t.Fatalf("ungated pull request tallied: %v", pr.Created)
+	}
+	record, err := loadRecord(ctx, "owner/repo", 334)
+	if err != nil {
+		t.Fatalf("failed to load record: %v", err)
+	}
+	if record.Disabled {
+		t.Fatalf("opt-out not cleared")
+	}
+	labeled("labeled", "needs-votes", "needs-votes")
+	if len(pr.Created) != 1 {
+		t.Errorf("report not restored after opting back in: %v", pr.Created)
+	}
+}
+
+// Tests that pull requests authored by bots get no tally, neither on opening nor
+// on later votes.
+func TestBotAuthoredSkipped(t *testing.T) {
+	defer func(old *regexp.Regexp) { botAuthors = old }(botAuthors)
+	botAuthors = regexp.MustCompile(`\[bot\]$`)
+
+	bot := &fakePR{Number: 335, Author: "dependabot[bot]", Comments: []*github.IssueComment{newComment(1, "alice", ":+1:", 0)}}
+	human := &fakePR{Number: 336, Author: "alice"}
+	useTestAPI(t, human.install(bot.install(make(map[string]http.HandlerFunc))))
+
+	for _, pr := range []*fakePR{bot, human} {
+		rec := deliver(t, &Event{Action: "opened", Repository: testRepo, PullRequest: &PullRequest{
+			Number: pr.Number,
+			User:   &User{Login: pr.Author},
+			Head:   &Endpoint{Branch: "update", SHA: "abcdef"},
+			Base:   &Endpoint{Branch: "dev"},
+		}})
+		if rec.Code != http.StatusOK {
+			t.Fatalf("PR #%d: opening failed: %d %s", pr.Number, rec.Code, rec.Body)
+		}
+	}
+	ctx := newContext(t)
+	if _, err := refresh(ctx, newClient(ctx), "owner", "repo", bot.Number, true, false); err != nil {
+		t.Fatalf("failed to refresh: %v", err)
+	}
+	if len(bot.Created) != 0 || len(bot.Edited) != 0 {
+		t.Errorf("bot authored pull request tallied: created %v, edited %v", bot.Created, bot.Edited)
+	}
+	if len(human.Created) != 1 {
+		t.Errorf("human authored pull request not tallied: %v", human.Created)
+	}
+}
+
+// Tests that the report links back to its pull request if configured, both when
+// posted on opening and when refreshed.
+func TestLinkHeader(t *testing.T) {
+	defer func(old bool) { linkHeader = old }(linkHeader)
+	linkHeader = true
+
+	pr := &fakePR{Number: 337, Author: "author"}
+	useTestAPI(t, pr.install(make(map[string]http.HandlerFunc)))
+
+	rec := deliver(t, &Event{Action: "opened", Repository: testRepo, PullRequest: &PullRequest{
+		Number:  337,
+		HTMLURL: "https://github.com/owner/repo/pull/337",
+		User:    &User{Login: "author"},
+		Head:    &Endpoint{SHA: "0123456789abcdef"},
+		Base:    &Endpoint{Branch: "dev"},
+	}})
+	if rec.Code != http.StatusOK || len(pr.Created) != 1 {
+		t.Fatalf("opening failed: %d %s", rec.Code, rec.Body)
+	}
+	header := "_Review tally of https://github.com/owner/repo/pull/337_"
+	if !strings.Contains(pr.Created[0], header) {
+		t.Errorf("link missing from opened report:\n%s", pr.Created[0])
+	}
+	ctx := newContext(t)
+	if _, err := refresh(ctx, newClient(ctx), "owner", "repo", 337, false, true); err != nil {
+		t.Fatalf("failed to refresh: %v", err)
+	}
+	if len(pr.Edited) != 1 {
+		t.Fatalf("report not refreshed")
+	}
+	for _, report := range pr.Edited {
+		if !strings.Contains(report, header) {
+			t.Errorf("link missing from refreshed report:\n%s", report)
+		}
+	}
+}
+
+// Tests that the votes of linked pull requests are filtered like those of the PR
+// itself, plain issues skipped and every voter combined only once.
+func TestLinkedVotes(t *testing.T) {
+	defer func(old bool) { authorVotes = old }(authorVotes)
+	authorVotes = false
+
+	client := newTestClient(t, map[string]http.HandlerFunc{
+		"GET /repos/owner/repo/issues/10": func(w http.ResponseWriter, r *http.Request) {
+			reply(w, &github.Issue{Number: github.Int(10), User: &github.User{Login: github.String("dave")}, PullRequestLinks: &github.PullRequestLinks{}})
+		},
+		"GET /repos/owner/repo/issues/11": func(w http.ResponseWriter, r *http.Request) {
+			reply(w, &github.Issue{Number: github.Int(11), User: &github.User{Login: github.String("erin")}})
+		},
+		"GET /repos/owner/repo/issues/12": func(w http.ResponseWriter, r *http.Request) {
+			http.Error(w, `{"message": "Not Found"}`, http.StatusNotFound)
+		},
+		"GET /repos/owner/repo/issues/10/comments": func(w http.ResponseWriter, r *http.Request) {
+			reply(w, []*github.IssueComment{
+				newComment(1, "alice", ":-1:", 0),
+				newComment(2, "bob", ":-1:", time.Minute),
+				newComment(3, "dave", ":+1:", 2*time.Minute),
+			})
+		},
+	})
+	linked, err := linkedVotes(client, "owner", "repo", 336, "Follows #10 and #11, see #12 and #336", make(map[string]string))
+	if err != nil {
+		t.Fatalf("failed to aggregate linked votes: %v", err)
+	}
+	if want := map[int]map[string]bool{10: {"alice": false, "bob": false}}; !reflect.DeepEqual(linked, want) {
+		t.Fatalf("linked votes mismatch: have %v, want %v", linked, want)
+	}
+	report := status(markdown, &tally{Votes: map[string]bool{"alice": true, "carol": true}, Linked: linked})
+	for _, row := range []string{
+		"| This PR | 2 @alice @carol | 0 |",
+		"| #10 | 0 | 2 @alice @bob |",
+		"| Combined | 2 @alice @carol | 1 @bob |",
+	} {
+		if !strings.Contains(report, row) {
+			t.Errorf("report row %q missing:\n%s", row, report)
+		}
+	}
+}
+
+// Tests that the report is edited through its stored comment ID, falling back to
+// creating a new one if that comment was deleted.
+func TestPostStoredComment(t *testing.T) {
+	var edits, creates int
+	client := newTestClient(t, map[string]http.HandlerFunc{
+		"PATCH /repos/owner/repo/issues/comments/55": func(w http.ResponseWriter, r *http.Request) {
+			edits++
+			reply(w, &github.IssueComment{ID: github.Int(55)})
+		},
+		"PATCH /repos/owner/repo/issues/comments/66": func(w http.ResponseWriter, r *http.Request) {
+			http.Error(w, `{"message": "Not Found"}`, http.StatusNotFound)
+		},
+		"POST /repos/owner/repo/issues/337/comments": func(w http.ResponseWriter, r *http.Request) {
+			creates++
+			reply(w, &github.IssueComment{ID: github.Int(77)})
+		},
+	})
+	ctx := newContext(t)
+
+	id, err := post(ctx, client, "owner", "repo", 337, 55, nil, true, "report")
+	if err != nil || id != 55 || edits != 1 || creates != 0 {
+		t.Fatalf("stored comment edit mismatch: id %d, err %v, %d edits, %d creates", id, err, edits, creates)
+	}
+	id, err = post(ctx, client, "owner", "repo", 337, 66, nil, true, "report")
+	if err != nil || id != 77 || creates != 1 {
+		t.Fatalf("deleted comment fallback mismatch: id %d, err %v, %d creates", id, err, creates)
+	}
+	id, err = post(ctx, client, "owner", "repo", 337, 66, nil, false, "report")
+	if err != nil || id != 0 || creates != 1 {
+		t.Errorf("edit only fallback mismatch: id %d, err %v, %d creates", id, err, creates)
+	}
+}
+
+// Tests that refreshing a report only edits it if the tally changed, ignoring the
+// timestamp in a multi-paragraph footer.
+func TestIdempotentRefresh(t *testing.T) {
+	defer func(template string, line *template.Template, clock func() time.Time) {
+		footerTemplate, footerLine, now = template, line, clock
+	}(footerTemplate, footerLine, now)
+
+	footerTemplate = "Updated: {{.Updated.Format \"15:04:05\"}}\n\nMaintained by the core team."
+	footerLine = template.Must(template.New("footer").Parse(footerTemplate))
+
+	clock := testTime
+	now = func() time.Time { return clock }
+
+	pr := &fakePR{Number: 3372, Author: "author", Comments: []*github.IssueComment{
+		newComment(1, githubUser, summaryMarker+"\n\nstale report", 0),
+		newComment(2, "alice", ":+1:", time.Minute),
+	}}
+	useTestAPI(t, pr.install(make(map[string]http.HandlerFunc)))
+
+	ctx := newContext(t)
+	refreshed := func() {
+		if _, err := refresh(ctx, newClient(ctx), "owner", "repo", 3372, false, false); err != nil {
+			t.Fatalf("failed to refresh: %v", err)
+		}
+	}
+	refreshed()
+	if pr.Edits != 1 || !strings.Contains(pr.Edited[1], "Updated: 12:00:00") {
+		t.Fatalf("stale report not edited: %d edits\n%s", pr.Edits, pr.Edited[1])
+	}
+	// Refresh later with an unchanged tally, the timestamp alone mustn't edit
+	clock = clock.Add(time.Hour)
+	refreshed()
+	if pr.Edits != 1 {
+		t.Fatalf("unchanged report edited: %d edits", pr.Edits)
+	}
+	// Add a vote and refresh again, the report must be updated
+	pr.Comments = append(pr.Comments, newComment(3, "bob", ":+1:", 2*time.Minute))
+	refreshed()
+	if pr.Edits != 2 || !strings.Contains(pr.Edited[1], "@alice @bob") || !strings.Contains(pr.Edited[1], "Updated: 13:00:00") {
+		t.Errorf("changed report not edited: %d edits\n%s", pr.Edits, pr.Edited[1])
+	}
+}
+
+// Tests that the reactions are rendered under their configured groups, the rest
+// falling into a default section.
+func TestReactionGroups(t *testing.T) {
+	defer func(old []reactionGroup) { reactionGroups = old }(reactionGroups)
+	reactionGroups = []reactionGroup{
+		{Name: "Celebration", Emojis: []string{":tada:", ":rocket:"}},
+		{Name: "Concern", Emojis: []string{":confused:"}},
+	}
+	report := status(markdown, &tally{Reactions: map[string]map[string]struct{}{
+		":rocket:":   {"alice": {}},
+		":confused:": {"bob": {}},
+		":eyes:":     {"carol": {}},
+	}})
+	want := strings.Join([]string{
+		"| **Celebration** |  |  |",
+		"| :rocket: | 1 | @alice |",
+		"| **Concern** |  |  |",
+		"| :confused: | 1 | @bob |",
+		"| **Other** |  |  |",
+		"| :eyes: | 1 | @carol |",
+	}, "\n")
+	if !strings.Contains(report, want) {
+		t.Errorf("grouped reactions mismatch: want\n%s\nin\n%s", want, report)
+	}
+}
+
+// Tests that reports with too many reactions to list are collapsed to fit within
+// GitHub's comment size limit.
+func TestOversizedReactions(t *testing.T) {
+	reactions := make(map[string]map[string]struct{})
+	for i := 0; i < 10; i++ {
+		users := make(map[string]struct{})
+		for j := 0; j < 1000; j++ {
+			users[fmt.Sprintf("reviewer-%d-%d", i, j)] = struct{}{}
+		}
+		reactions[fmt.Sprintf(":emoji%d:", i)] = users
+	}
+	report := status(markdown, &tally{Reactions: reactions})
+	if len(report) > maxReportSize {
+		t.Fatalf("report exceeds size limit: %d > %d", len(report), maxReportSize)
+	}
+	if strings.Contains(report, "@reviewer-") {
+		t.Errorf("reactions not collapsed to counts:\n%s", report)
+	}
+	if !strings.Contains(report, "| :emoji0: | 1000 |  |") {
+		t.Errorf("collapsed reaction counts missing:\n%s", report)
+	}
+}
+
+// Tests that deferred reports are not posted when the pull request is opened,
+// but only once the first vote is cast.
+func TestDeferredReport(t *testing.T) {
+	defer func(old bool) { deferReport = old }(deferReport)
+	deferReport = true
+
+	pr := &fakePR{Number: 344, Author: "author"}
+	useTestAPI(t, pr.install(make(map[string]http.HandlerFunc)))
+
+	opened := deliver(t, &Event{Action: "opened", Repository: testRepo, PullRequest: &PullRequest{Number: 344, User: &User{Login: "author"}}})
+	if opened.Code != http.StatusOK || len(pr.Created) != 0 {
+		t.Fatalf("deferred report posted on open: %d, %v", opened.Code, pr.Created)
+	}
+	pr.Comments = append(pr.Comments, newComment(1, "alice", ":+1:", 0))
+	voted := deliver(t, &Event{
+		Action:     "created",
+		Repository: testRepo,
+		Issue:      &Issue{Number: 344, PullRequest: &IssueLink{}},
+		Comment:    &Comment{ID: 1, Body: ":+1:", User: &User{Login: "alice"}},
+		Sender:     &User{Login: "alice"},
+	})
+	if voted.Code != http.StatusOK {
+		t.Fatalf("vote processing failed: %d %s", voted.Code, voted.Body)
+	}
+	if len(pr.Created) != 1 || !strings.Contains(pr.Created[0], "| :+1: | 1 | @alice |") {
+		t.Errorf("report not created on first vote: %v", pr.Created)
+	}
+}
+
+// Tests that the review state is contested if there are both up and downvotes,
+// and a consensus if all the votes agree.
+func TestReviewState(t *testing.T) {
+	tests := []struct {
+		votes map[string]bool
+		state string
+	}{
+		{map[string]bool{}, ""},
+		{map[string]bool{"alice": true, "bob": true}, "consensus"},
+		{map[string]bool{"alice": false}, "consensus"},
+		{map[string]bool{"alice": true, "bob": true, "carol": false}, "contested"},
+	}
+	for i, tt := range tests {
+		report := status(markdown, &tally{Votes: tt.votes})
+		if tt.state == "" {
+			if strings.Contains(report, "Review state") {
+				t.Errorf("test %d: review state reported without votes:\n%s", i, report)
+			}
+			continue
+		}
+		if want := "_Review state: " + tt.state + "_"; !strings.Contains(report, want) {
+			t.Errorf("test %d: review state %q missing:\n%s", i, want, report)
+		}
+	}
+}
+
+// Tests that prioritized reactions are listed before more popular ones, the rest
+// following by popularity.
+func TestReactionPriority(t *testing.T) {
+	defer func(old []string) { reactionPriority = old }(reactionPriority)
+	reactionPriority = []string{":warning:"}
+
+	report := status(markdown, &tally{Reactions: map[string]map[string]struct{}{
+		":tada:":    {"alice": {}, "bob": {}, "carol": {}},
+		":warning:": {"dave": {}},
+		":eyes:":    {"alice": {}, "bob": {}},
+	}})
+	want := strings.Join([]string{
+		"| :warning: | 1 | @dave |",
+		"| :tada: | 3 | @alice @bob @carol |",
+		"| :eyes: | 2 | @alice @bob |",
+	}, "\n")
+	if !strings.Contains(report, want) {
+		t.Errorf("reaction order mismatch: want\n%s\nin\n%s", want, report)
+	}
+}
+
+// Tests that votes older than the freshness window move to the stale rows, unless
+// their author voted again since.
+func TestStaleVotes(t *testing.T) {
+	defer func(old time.Duration) { freshness = old }(freshness)
+	freshness = 24 * time.Hour
+
+	defer func(old func() time.Time) { now = old }(now)
+	now = func() time.Time { return testTime.Add(48 * time.Hour) }
+
+	comments := []*github.IssueComment{
+		newComment(1, "alice", ":+1:", 0),
+		newComment(2, "bob", ":-1:", time.Hour),
+		newComment(3, "carol", ":+1:", 30*time.Hour),
+		newComment(4, "bob", ":+1:", 40*time.Hour),
+	}
+	votes, stale, _ := aggregate(comments, nil, time.Time{}, nil, nil, nil)
+	if want := map[string]bool{"carol": true, "bob": true}; !reflect.DeepEqual(votes, want) {
+		t.Errorf("fresh votes mismatch: have %v, want %v", votes, want)
+	}
+	if want := map[string]bool{"alice": true}; !reflect.DeepEqual(stale, want) {
+		t.Errorf("stale votes mismatch: have %v, want %v", stale, want)
+	}
+	report := status(markdown, &tally{Votes: votes, Stale: stale})
+	for _, row := range []string{"| :+1: | 2 | @bob @carol |", "| :+1: (stale) | 1 | @alice |", "| :-1: (stale) | 0 |  |"} {
+		if !strings.Contains(report, row) {
+			t.Errorf("report row %q missing:\n%s", row, report)
+		}
+	}
+}
+
+// Tests that comments of deleted users, lacking an author, are skipped instead of
+// crashing the aggregation.
+func TestDeletedUserComment(t *testing.T) {
+	ghost := newComment(2, "", ":-1: :tada:", time.Minute)
+	ghost.User = nil
+
+	comments := []*github.IssueComment{newComment(1, "alice", ":+1:", 0), ghost}
+	votes, _, reactions := aggregate(comments, nil, time.Time{}, nil, nil, nil)
+	if want := map[string]bool{"alice": true}; !reflect.DeepEqual(votes, want) {
+		t.Errorf("votes mismatch: have %v, want %v", votes, want)
+	}
+	if len(reactions) != 0 {
+		t.Errorf("reactions of deleted user gathered: %v", reactions)
+	}
+}
+
+// Tests that the reactions table counts the users reacting with each emoji, not
+// the occurrences of it.
+func TestReactionCounts(t *testing.T) {
+	comments := []*github.IssueComment{
+		newComment(1, "alice", ":tada: :tada: :eyes:", 0),
+		newComment(2, "bob", ":tada:", time.Minute),
+		newComment(3, "carol", ":tada: :+1:", 2*time.Minute),
+		newComment(4, "alice", ":tada:", 3*time.Minute),
+	}
+	votes, _, reactions := aggregate(comments, nil, time.Time{}, nil, nil, nil)
+	report := status(markdown, &tally{Votes: votes, Reactions: reactions})
+
+	want := "| Reaction | Count | Users |\n| :---: | :---: | :---: |\n| :tada: | 3 | @alice @bob @carol |\n| :eyes: | 1 | @alice |"
+	if !strings.Contains(report, want) {
+		t.Errorf("reaction counts mismatch: want\n%s\nin\n%s", want, report)
+	}
+}
+
+// Tests that a report comment deleted between listing and editing it is posted
+// anew instead of failing the refresh.
+func TestVanishedReport(t *testing.T) {
+	pr := &fakePR{Number: 356, Author: "author", Comments: []*github.IssueComment{
+		newComment(1, githubUser, summaryMarker+"\n\nstale report", 0),
+		newComment(2, "alice", ":+1:", time.Minute),
+	}}
+	routes := pr.install(make(map[string]http.HandlerFunc))
+	routes["PATCH /repos/owner/repo/issues/comments/1"] = func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, `{"message": "Not Found"}`, http.StatusNotFound)
+	}
+	useTestAPI(t, routes)
+
+	ctx := newContext(t)
+	out, err := refresh(ctx, newClient(ctx), "owner", "repo", 356, false, false)
+	if err != nil {
+		t.Fatalf("failed to refresh: %v", err)
+	}
+	if len(pr.Created) != 1 || !strings.Contains(pr.Created[0], "| :+1: | 1 | @alice |") {
+		t.Fatalf("vanished report not posted anew: %v", pr.Created)
+	}
+	if out.CommentID != 3560000 {
+		t.Errorf("reposted comment mismatch: have %d, want %d", out.CommentID, 3560000)
+	}
+	record, err := loadRecord(ctx, "owner/repo", 356)
+	if err != nil {
+		t.Fatalf("failed to load record: %v", err)
+	}
+	if record.CommentID != 3560000 {
+		t.Errorf("stored comment mismatch: have %d, want %d", record.CommentID, 3560000)
+	}
+}
+
+// Tests that pull requests against master are warned about, unless authored by
+// someone exempt from the warning.
+func TestBranchWarningExempt(t *testing.T) {
+	defer func(old map[string]bool) { warningExempt = old }(warningExempt)
+	warningExempt = map[string]bool{"release-bot": true}
+
+	if warnings := prWarnings("master", "alice", 0); !reflect.DeepEqual(warnings, []string{"Pull request against `master`"}) {
+		t.Errorf("protected branch warning mismatch: %v", warnings)
+	}
+	if warnings := prWarnings("master", "release-bot", 0); len(warnings) != 0 {
+		t.Errorf("exempt author warned: %v", warnings)
+	}
+	if warnings := prWarnings("dev", "alice", 0); len(warnings) != 0 {
+		t.Errorf("unprotected branch warned: %v", warnings)
+	}
+	if report := status(markdown, &tally{Warnings: prWarnings("master", "release-bot", 0)}); strings.Contains(report, ":exclamation:") {
+		t.Errorf("exempt author report contains warning:\n%s", report)
+	}
+}
+
+// Tests that thumbs reactions on review comments are gathered as inline agreement
+// across all pages of both the comments and their reactions.
+func TestInlineAgreement(t *testing.T) {
+	routes := make(map[string]http.HandlerFunc)
+
+	var first, second []*github.PullRequestComment
+	for id := 1; id <= 100; id++ {
+		first = append(first, &github.PullRequestComment{ID: github.Int(id)})
+		routes[fmt.Sprintf("GET /repos/owner/repo/pulls/comments/%d/reactions", id)] = func(w http.ResponseWriter, r *http.Request) {
+			reply(w, []*github.Reaction{})
+		}
+	}
+	second = append(second, &github.PullRequestComment{ID: github.Int(101)})
+	routes["GET /repos/owner/repo/pulls/358/comments"] = func(w http.ResponseWriter, r *http.Request) {
+		replyPages(w, r, first, second)
+	}
+	var hearts []*github.Reaction
+	for i := 0; i < 100; i++ {
+		hearts = append(hearts, &github.Reaction{User: &github.User{Login: github.String(fmt.Sprintf("fan-%d", i))}, Content: github.String("heart")})
+	}
+	routes["GET /repos/owner/repo/pulls/comments/101/reactions"] = func(w http.ResponseWriter, r *http.Request) {
+		replyPages(w, r, hearts, []*github.Reaction{
+			{User: &github.User{Login: github.String("alice")}, Content: github.String("+1")},
+			{User: &github.User{Login: github.String("bob")}, Content: github.String("-1")},
+			{User: &github.User{Login: github.String(githubUser)}, Content: github.String("+1")},
+		})
+	}
+	inline, err := inlineAgreement(newTestClient(t, routes), "owner", "repo", 358)
+	if err != nil {
+		t.Fatalf("failed to gather inline agreement: %v", err)
+	}
+	want := map[string]map[string]struct{}{
+		upvoteEmoji:   {"alice": {}},
+		downvoteEmoji: {"bob": {}},
+	}
+	if !reflect.DeepEqual(inline, want) {
+		t.Errorf("inline agreement mismatch: have %v, want %v", inline, want)
+	}
+	report := status(markdown, &tally{Inline: inline})
+	if !strings.Contains(report, "**Inline agreement**\n\n| Reaction | Count | Users |\n| :---: | :---: | :---: |\n| :+1: | 1 | @alice |") {
+		t.Errorf("inline agreement not reported:\n%s", report)
+	}
+	// A pull request without any review comment reactions has no inline section
+	routes["GET /repos/owner/repo/pulls/358/comments"] = func(w http.ResponseWriter, r *http.Request) {
+		replyPages(w, r, first)
+	}
+	if inline, err = inlineAgreement(newTestClient(t, routes), "owner", "repo", 358); err != nil {
+		t.Fatalf("failed to gather inline agreement: %v", err)
+	}
+	if report := status(markdown, &tally{Inline: inline}); strings.Contains(report, "Inline agreement") {
+		t.Errorf("empty inline agreement reported:\n%s", report)
+	}
+}
+
+// Tests that the last vote of a user is resolved deterministically even if the
+// comments were created at the same instant, the later ID winning.
+func TestSameTimestampVotes(t *testing.T) {
+	for _, order := range [][]int{{7, 8}, {8, 7}} {
+		var comments []*github.IssueComment
+		for _, id := range order {
+			body := ":+1:"
+			if id == 8 {
+				body = ":-1:"
+			}
+			comments = append(comments, newComment(id, "alice", body, 0))
+		}
+		chronological(comments)
+
+		if *comments[0].ID != 7 || *comments[1].ID != 8 {
+			t.Errorf("order %v: comments not sorted by ID: %d, %d", order, *comments[0].ID, *comments[1].ID)
+		}
+		votes, _, _ := aggregate(comments, nil, time.Time{}, nil, nil, nil)
+		if want := map[string]bool{"alice": false}; !reflect.DeepEqual(votes, want) {
+			t.Errorf("order %v: votes mismatch: have %v, want %v", order, votes, want)
+		}
+	}
+}
+
+// Tests that events from repositories outside of the allowlist are skipped
+// without touching GitHub.
+func TestAllowedRepos(t *testing.T) {
+	defer func(old map[string]bool) { allowedRepos = old }(allowedRepos)
+	allowedRepos = map[string]bool{"owner/other": true}
+
+	calls := 0
+	useTestAPI(t, map[string]http.HandlerFunc{
+		"POST /repos/owner/repo/issues/361/comments": func(w http.ResponseWriter, r *http.Request) {
+			calls++
+			reply(w, &github.IssueComment{ID: github.Int(1)})
+		},
+	})
+	opened := &Event{Action: "opened", Repository: testRepo, PullRequest: &PullRequest{
+		Number: 361, User: &User{Login: "author"}, Head: &Endpoint{SHA: "0123456789abcdef"}, Base: &Endpoint{Branch: "dev"},
+	}}
+	rec := deliver(t, opened)
+	if rec.Code != http.StatusOK || calls != 0 {
+		t.Errorf("non-allowlisted repository processed: %d, %d calls", rec.Code, calls)
+	}
+	allowedRepos["owner/repo"] = true
+
+	rec = deliver(t, opened)
+	if rec.Code != http.StatusOK || calls != 1 {
+		t.Errorf("allowlisted repository skipped: %d, %d calls", rec.Code, calls)
+	}
+}
+
+// Tests that weighted reactions add up into the soft score, each user counting
+// once per emoji, even with the reactions table hidden.
+func TestSoftScore(t *testing.T) {
+	defer func(weights map[string]float64, table bool) { softWeights, reactionTable = weights, table }(softWeights, reactionTable)
+	softWeights, reactionTable = map[string]float64{":eyes:": 0.5}, false
+
+	comments := []*github.IssueComment{
+		newComment(1, "alice", ":eyes:", 0),
+		newComment(2, "bob", ":eyes: :tada:", time.Minute),
+		newComment(3, "alice", ":eyes: again", 2*time.Minute),
+	}
+	_, _, reactions := aggregate(comments, nil, time.Time{}, nil, nil, nil)
+	if score := softScore(reactions); score != 1.0 {
+		t.Errorf("soft score mismatch: have %v, want %v", score, 1.0)
+	}
+	if report := status(markdown, &tally{Soft: softScore(reactions)}); !strings.Contains(report, "_Soft score: 1.00_") {
+		t.Errorf("soft score not reported:\n%s", report)
+	}
+}
+
+// Tests that comments are listed oldest first even if the API returns them in
+// descending order, so the latest vote of a user wins.
+func TestCommentOrder(t *testing.T) {
+	client := newTestClient(t, map[string]http.HandlerFunc{
+		"GET /repos/owner/repo/issues/364/comments": func(w http.ResponseWriter, r *http.Request) {
+			if query := r.URL.Query(); query.Get("sort") != "created" || query.Get("direction") != "asc" {
+				t.Errorf("comment order not requested: %v", query)
+			}
+			reply(w, []*github.IssueComment{
+				newComment(3, "alice", ":-1:", 2*time.Minute),
+				newComment(2, "bob", ":+1:", time.Minute),
+				newComment(1, "alice", ":+1:", 0),
+			})
+		},
+	})
+	comments, _, err := listComments(client, "owner", "repo", 364)
+	if err != nil {
+		t.Fatalf("failed to list comments: %v", err)
+	}
+	for i, comment := range comments {
+		if *comment.ID != i+1 {
+			t.Errorf("comment %d: ID mismatch: have %d, want %d", i, *comment.ID, i+1)
+		}
+	}
+	votes, _, _ := aggregate(comments, nil, time.Time{}, nil, nil, nil)
+	if want := map[string]bool{"alice": false, "bob": true}; !reflect.DeepEqual(votes, want) {
+		t.Errorf("votes mismatch: have %v, want %v", votes, want)
+	}
+}
+
+// Tests that failing to retrieve the reactions still renders the tally of the
+// comment votes, noting that the reactions are missing.
+func TestDegradedReactions(t *testing.T) {
+	defer func(old bool) { inlineVotes = old }(inlineVotes)
+	inlineVotes = true
+
+	pr := &fakePR{Number: 365, Author: "author", Comments: []*github.IssueComment{
+		newComment(1, githubUser, summaryMarker+"\n\nstale report", 0),
+		newComment(2, "alice", ":+1:", time.Minute),
+	}}
+	routes := pr.install(make(map[string]http.HandlerFunc))
+	routes["GET /repos/owner/repo/pulls/365/comments"] = func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, `{"message": "Resource not accessible by integration"}`, http.StatusForbidden)
+	}
+	useTestAPI(t, routes)
+
+	ctx := newContext(t)
+	if _, err := refresh(ctx, newClient(ctx), "owner", "repo", 365, false, false); err != nil {
+		t.Fatalf("failed to refresh: %v", err)
+	}
+	for _, want := range []string{"| :+1: | 1 | @alice |", "_Reactions unavailable, tallied comments only_"} {
+		if !strings.Contains(pr.Edited[1], want) {
+			t.Errorf("degraded report missing %q:\n%s", want, pr.Edited[1])
+		}
+	}
+}
+
+// Tests that the reactions table is capped to the configured number of rows, the
+// least popular emojis summarized in a single line.
+func TestReactionRowCap(t *testing.T) {
+	defer func(old int) { reactionRows = old }(reactionRows)
+	reactionRows = 20
+
+	reactions := make(map[string]map[string]struct{})
+	for i := 0; i < 25; i++ {
+		users := make(map[string]struct{})
+		for j := 0; j <= i; j++ {
+			users[fmt.Sprintf("user-%d", j)] = struct{}{}
+		}
+		reactions[fmt.Sprintf(":emoji%02d:", i)] = users
+	}
+	report := status(markdown, &tally{Reactions: reactions})
+	if rows := strings.Count(report, "| :emoji"); rows != 20 {
+		t.Errorf("reaction row count mismatch: have %d, want %d", rows, 20)
+	}
+	if !strings.Contains(report, "| :emoji24: | 25 |") || strings.Contains(report, "| :emoji04: |") {
+		t.Errorf("least popular reactions not dropped:\n%s", report)
+	}
+	if !strings.Contains(report, "_+5 more reactions_") {
+		t.Errorf("overflow summary missing:\n%s", report)
+	}
+}
+
+// Tests that with a vote marker configured, only the marked lines cast votes and
+// vote emojis in the surrounding prose are ignored.
+func TestVoteMarker(t *testing.T) {
+	defer func(old string) { voteMarker = old }(voteMarker)
+	voteMarker = "vote:"
+
+	comments := []*github.IssueComment{
+		newComment(1, "alice", "The :+1: from last week doesn't apply anymore", 0),
+		newComment(2, "bob", "Reviewed the docs, :-1: on the naming only\n\nvote: :+1:", time.Minute),
+		newComment(3, "carol", "  vote: :-1:  ", 2*time.Minute),
+	}
+	votes, _, _ := aggregate(comments, nil, time.Time{}, nil, nil, nil)
+	if want := map[string]bool{"bob": true, "carol": false}; !reflect.DeepEqual(votes, want) {
+		t.Errorf("votes mismatch: have %v, want %v", votes, want)
+	}
+}
+
+// Benchmarks aggregating the votes and reactions of a long discussion, which
+// is dominated by the emoji matching of each comment.
+func BenchmarkAggregate(b *testing.B) {
+	comments := make([]*github.IssueComment, 1000)
+	for i := range comments {
+		body := fmt.Sprintf("Looked at it again :eyes: and :tada:, still %s\n\nSome more prose to scan through.", []string{":+1:", ":-1:"}[i%2])
+		comments[i] = newComment(i+1, fmt.Sprintf("user-%d", i%50), body, time.Duration(i)*time.Minute)
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		aggregate(comments, nil, time.Time{}, nil, nil, nil)
+	}
+}
+
+// Tests that hyphenated and signed emoji shortcodes are recognized, while times
+// and ranges containing colons aren't mistaken for emojis.
+func TestEmojiShortcodes(t *testing.T) {
+	tests := []struct {
+		text   string
+		emojis []string
+	}{
+		{":+1: :-1: :e-mail: :t-rex:", []string{":+1:", ":-1:", ":e-mail:", ":t-rex:"}},
+		{"Sync at 10:30-11:45 tomorrow :calendar:", []string{":calendar:"}},
+		{"Ran at 12:00:00 :tada::rocket:", []string{":tada:", ":rocket:"}},
+		{"ratio 3:2:1", nil},
+	}
+	for i, tt := range tests {
+		if found := emojis(tt.text); !reflect.DeepEqual(found, tt.emojis) {
+			t.Errorf("test %d: emojis mismatch: have %v, want %v", i, found, tt.emojis)
+		}
+	}
+	// With custom vote emojis, the default thumbs must not show up as reactions
+	defer func(up, down string) { upvoteEmoji, downvoteEmoji = up, down }(upvoteEmoji, downvoteEmoji)
+	upvoteEmoji, downvoteEmoji = ":white_check_mark:", ":x:"
+
+	comments := []*github.IssueComment{newComment(1, "alice", ":+1: :-1: :e-mail: at 10:30-11:45", 0)}
+	if _, _, reactions := aggregate(comments, nil, time.Time{}, nil, nil, nil); !reflect.DeepEqual(reactions, map[string]map[string]struct{}{":e-mail:": {"alice": {}}}) {
+		t.Errorf("reactions mismatch: %v", reactions)
+	}
+}
+
+// Tests that the status report is told apart from other comments of the bot by
+// its marker, reports posted before markers still being found by their table.
+func TestSummaryComment(t *testing.T) {
+	legacy := "| Vote | Count | Reviewers |\n| :---: | :---: | :---: |\n| :+1: | 0 |  |\n| :-1: | 0 |  |\n\nUpdated: Mon Jan 1 12:00:00 UTC 2018"
+	comments := []*github.IssueComment{
+		newComment(1, githubUser, "Tallying disabled by @alice", 0),
+		newComment(2, githubUser, legacy, time.Minute),
+		newComment(3, "alice", "Quoting:\n> "+legacy, 2*time.Minute),
+	}
+	if report := summary(comments); report == nil || *report.ID != 2 {
+		t.Errorf("legacy report not found: %v", report)
+	}
+	comments = append(comments, newComment(4, githubUser, summaryMarker+"\n\n"+legacy, 3*time.Minute))
+	if report := summary(comments); report == nil || *report.ID != 4 {
+		t.Errorf("marked report not preferred: %v", report)
+	}
+	if report := summary(comments[:1]); report != nil {
+		t.Errorf("unrelated bot comment mistaken for report: %v", *report.ID)
+	}
+}
+
+// Tests that merging a pull request finalizes and freezes its report if asked
+// to, and that reopening it brings the report back to live tallying.
+func TestCloseAndReopen(t *testing.T) {
+	defer func(old bool) { lockOnClose = old }(lockOnClose)
+	lockOnClose = true
+
+	pr := &fakePR{Number: 376, Author: "author", Comments: []*github.IssueComment{
+		newComment(1, githubUser, summaryMarker+"\n\nstale report", 0),
+		newComment(2, "alice", ":+1:", time.Minute),
+	}}
+	useTestAPI(t, pr.install(make(map[string]http.HandlerFunc)))
+
+	event := func(action string, merged bool) {
+		rec := deliver(t, &Event{Action: action, Repository: testRepo, PullRequest: &PullRequest{Number: 376, User: &User{Login: "author"}, Merged: merged}})
+		if rec.Code != http.StatusOK {
+			t.Fatalf("%s event failed: %d %s", action, rec.Code, rec.Body)
+		}
+	}
+	event("closed", true)
+	if !strings.Contains(pr.Edited[1], "**Merged with 1 approvals**") {
+		t.Fatalf("merged report not finalized:\n%s", pr.Edited[1])
+	}
+	// Further votes must not touch the frozen report
+	pr.Comments = append(pr.Comments, newComment(3, "bob", ":+1:", 2*time.Minute))
+
+	ctx := newContext(t)
+	if _, err := refresh(ctx, newClient(ctx), "owner", "repo", 376, false, false); err != nil {
+		t.Fatalf("failed to refresh: %v", err)
+	}
+	if pr.Edits != 1 {
+		t.Fatalf("frozen report edited: %d edits", pr.Edits)
+	}
+	event("reopened", false)
+	if strings.Contains(pr.Edited[1], "Merged") || !strings.Contains(pr.Edited[1], "| :+1: | 2 | @alice @bob |") {
+		t.Errorf("reopened report not live:\n%s", pr.Edited[1])
+	}
+	record, err := loadRecord(ctx, "owner/repo", 376)
+	if err != nil {
+		t.Fatalf("failed to load record: %v", err)
+	}
+	if record.Final != "" || record.Frozen {
+		t.Errorf("reopened record still final: %q, frozen %v", record.Final, record.Frozen)
+	}
+}
+
+// Tests that in edit only mode no report is ever created, a report seeded by a
+// human being maintained instead without crediting its votes to the seeder.
+func TestEditOnlyMode(t *testing.T) {
+	defer func(open, update bool) { createOnOpen, createOnUpdate = open, update }(createOnOpen, createOnUpdate)
+	createOnOpen, createOnUpdate = false, false
+
+	pr := &fakePR{Number: 377, Author: "author", Comments: []*github.IssueComment{
+		newComment(1, "alice", ":+1: :tada:", 0),
+	}}
+	useTestAPI(t, pr.install(make(map[string]http.HandlerFunc)))
+
+	opened := deliver(t, &Event{Action: "opened", Repository: testRepo, PullRequest: &PullRequest{
+		Number: 377, User: &User{Login: "author"}, Head: &Endpoint{SHA: "0123456789abcdef"}, Base: &Endpoint{Branch: "dev"},
+	}})
+	if opened.Code != http.StatusOK || len(pr.Created) != 0 {
+		t.Fatalf("report created on open: %d, %v", opened.Code, pr.Created)
+	}
+	voted := func() {
+		rec := deliver(t, &Event{
+			Action:     "created",
+			Repository: testRepo,
+			Issue:      &Issue{Number: 377, PullRequest: &IssueLink{}},
+			Comment:    &Comment{ID: 1, Body: ":+1: :tada:", User: &User{Login: "alice"}},
+			Sender:     &User{Login: "alice"},
+		})
+		if rec.Code != http.StatusOK {
+			t.Fatalf("vote processing failed: %d %s", rec.Code, rec.Body)
+		}
+	}
+	voted()
+	if len(pr.Created) != 0 {
+		t.Fatalf("report created on vote: %v", pr.Created)
+	}
+	// Seed a report by hand, already listing a vote and reaction, and vote again
+	pr.lock.Lock()
+	seed := newComment(2, "carol", summaryMarker+"\n\n| Vote | Count | Reviewers |\n| :---: | :---: | :---: |\n| :+1: | 1 | @alice |\n| :-1: | 0 |  |\n\n| Reaction | Count | Users |\n| :---: | :---: | :---: |\n| :tada: | 1 | @alice |", time.Minute)
+	pr.Comments = append(pr.Comments, seed)
+	pr.installComment(pr.routes, 2)
+	pr.lock.Unlock()
+
+	voted()
+	if len(pr.Created) != 0 {
+		t.Fatalf("report created despite the seeded one: %v", pr.Created)
+	}
+	for _, want := range []string{"| :+1: | 1 | @alice |", "| :tada: | 1 | @alice |"} {
+		if !strings.Contains(pr.Edited[2], want) {
+			t.Errorf("seeded report missing %q:\n%s", want, pr.Edited[2])
+		}
+	}
+	if strings.Contains(pr.Edited[2], "@carol") {
+		t.Errorf("seeded report credited to its seeder:\n%s", pr.Edited[2])
+	}
+}
+
+// Tests that a comment creates a missing report if updates may create one, and
+// skips it otherwise, the same as label changes and GitLab notes.
+func TestCommentCreatesReport(t *testing.T) {
+	defer func(old bool) { createOnUpdate = old }(createOnUpdate)
+
+	for i, create := range []bool{true, false} {
+		createOnUpdate = create
+
+		pr := &fakePR{Number: 3770 + i, Author: "author", Comments: []*github.IssueComment{
+			newComment(1, "alice", ":+1:", 0),
+		}}
+		useTestAPI(t, pr.install(make(map[string]http.HandlerFunc)))
+
+		rec := deliver(t, &Event{
+			Action:     "created",
+			Repository: testRepo,
+			Issue:      &Issue{Number: pr.Number, PullRequest: &IssueLink{}},
+			Comment:    &Comment{ID: 1, Body: ":+1:", User: &User{Login: "alice"}},
+			Sender:     &User{Login: "alice"},
+		})
+		if rec.Code != http.StatusOK {
+			t.Fatalf("create %v: vote processing failed: %d %s", create, rec.Code, rec.Body)
+		}
+		if create && (len(pr.Created) != 1 || !strings.Contains(pr.Created[0], "| :+1: | 1 | @alice |")) {
+			t.Errorf("create %v: missing report not created: %v", create, pr.Created)
+		}
+		if !create && len(pr.Created) != 0 {
+			t.Errorf("create %v: report created in edit only mode: %v", create, pr.Created)
+		}
+	}
+}
+
+// Tests that all the warnings of a report survive it being edited with a fresh
+// tally, each on its own line.
+func TestWarningsRoundTrip(t *testing.T) {
+	warnings := []string{"Pull request against `master`", "Large PR: 1200 lines changed"}
+	original := status(markdown, &tally{Warnings: warnings})
+
+	pr := &fakePR{Number: 379, Author: "author", Comments: []*github.IssueComment{
+		newComment(1, githubUser, original, 0),
+		newComment(2, "alice", ":+1:", time.Minute),
+	}}
+	useTestAPI(t, pr.install(make(map[string]http.HandlerFunc)))
+
+	ctx := newContext(t)
+	if _, err := refresh(ctx, newClient(ctx), "owner", "repo", 379, false, false); err != nil {
+		t.Fatalf("failed to refresh: %v", err)
+	}
+	want := ":exclamation: Pull request against `master` :exclamation:\n\n:exclamation: Large PR: 1200 lines changed :exclamation:"
+	if !strings.Contains(pr.Edited[1], want) || !strings.Contains(pr.Edited[1], "| :+1: | 1 | @alice |") {
+		t.Errorf("warnings lost in edit:\n%s", pr.Edited[1])
+	}
+}
+
+// Tests that opening a pull request changing more lines than the threshold warns
+// about it being large, smaller ones not being warned about.
+func TestLargeDiffWarning(t *testing.T) {
+	defer func(old int) { largeDiff = old }(largeDiff)
+	largeDiff = 500
+
+	for _, tt := range []struct {
+		number    int
+		additions int
+		deletions int
+		warned    bool
+	}{
+		{380, 600, 200, true},
+		{3800, 300, 200, false},
+	} {
+		pr := &fakePR{Number: tt.number, Author: "author"}
+		routes := pr.install(make(map[string]http.HandlerFunc))
+		routes[fmt.Sprintf("GET /repos/owner/repo/pulls/%d", tt.number)] = func(w http.ResponseWriter, r *http.Request) {
+			reply(w, &github.PullRequest{Number: github.Int(tt.number), Additions: github.Int(tt.additions), Deletions: github.Int(tt.deletions)})
+		}
+		useTestAPI(t, routes)
+
+		rec := deliver(t, &Event{Action: "opened", Repository: testRepo, PullRequest: &PullRequest{
+			Number: tt.number, User: &User{Login: "author"}, Head: &Endpoint{SHA: "0123456789abcdef"}, Base: &Endpoint{Branch: "dev"},
+		}})
+		if rec.Code != http.StatusOK || len(pr.Created) != 1 {
+			t.Fatalf("PR #%d: report not created: %d %s", tt.number, rec.Code, rec.Body)
+		}
+		warning := fmt.Sprintf(":exclamation: Large PR: %d lines changed :exclamation:", tt.additions+tt.deletions)
+		if warned := strings.Contains(pr.Created[0], warning); warned != tt.warned {
+			t.Errorf("PR #%d: large diff warning mismatch: have %v, want %v\n%s", tt.number, warned, tt.warned, pr.Created[0])
+		}
+	}
+}
+
+// Tests that the author's own reactions are left out of the report if configured
+// to, their vote still counting unless excluded separately.
+func TestAuthorEmojisExcluded(t *testing.T) {
+	defer func(old bool) { authorEmojis = old }(authorEmojis)
+	authorEmojis = false
+
+	comments := []*github.IssueComment{
+		newComment(1, "author", ":+1: :tada: :rocket:", 0),
+		newComment(2, "alice", ":tada:", time.Minute),
+	}
+	votes, stale, reactions := aggregate(comments, nil, time.Time{}, nil, nil, nil)
+	excludeAuthor("author", votes, stale, reactions)
+
+	if want := map[string]map[string]struct{}{":tada:": {"alice": {}}}; !reflect.DeepEqual(reactions, want) {
+		t.Errorf("reactions mismatch: have %v, want %v", reactions, want)
+	}
+	if want := map[string]bool{"author": true}; !reflect.DeepEqual(votes, want) {
+		t.Errorf("votes mismatch: have %v, want %v", votes, want)
+	}
+	report := status(markdown, &tally{Votes: votes, Reactions: reactions})
+	if strings.Contains(report, ":rocket:") || !strings.Contains(report, "| :tada: | 1 | @alice |") {
+		t.Errorf("author reactions reported:\n%s", report)
+	}
+}
@@ -0,0 +1,218 @@
+package robotally
+
+import (
+	"fmt"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+)
+
+// Record is the persisted state of the tally of a single pull request.
+type Record struct {
+	CommentID int       // Identifier of the status report comment
+	Commit    string    // Head commit of the PR at the time of the tally
+	Report    string    `datastore:",noindex"` // Last rendered status report
+	Updated   time.Time // Time of the last report update
+	Disabled  bool      // Whether tallying was opted out of for the PR
+	Final     string    // Final state of the PR once closed (Merged, Closed without merge)
+	Frozen    bool      // Whether the finalized report is not to be updated any more
+	ReviewID  int       // Identifier of the changes requested review, if submitted
+
+	CheckRun    int    // Identifier of the last published check run
+	CheckCommit string // Head commit the last check run was published on
+
+	Requested []string `datastore:",noindex"` // Reviewers already nudged for a review
+	Audit     []string `datastore:",noindex"` // Notes on the automated actions taken
+}
+
+// maxBatchSize is the number of entities Datastore accepts in a single batch
+// operation.
+const maxBatchSize = 500
+
+// maxAuditNotes is the number of most recent audit notes retained per record.
+const maxAuditNotes = 10
+
+// note appends an audit note to the record, dropping the oldest beyond the limit.
+func (r *Record) note(text string) {
+	if r.Audit = append(r.Audit, text); len(r.Audit) > maxAuditNotes {
+		r.Audit = r.Audit[len(r.Audit)-maxAuditNotes:]
+	}
+}
+
+// Preference is the persisted notification preference of a single reviewer.
+type Preference struct {
+	Muted bool // Whether the user opted out of being @mentioned
+}
+
+// repoKey creates the Datastore key grouping all records of a repository.
+func repoKey(ctx context.Context, repo string) *datastore.Key {
+	return datastore.NewKey(ctx, "Repository", repo, 0, nil)
+}
+
+// recordKey creates the Datastore key of a pull request's tally record.
+func recordKey(ctx context.Context, repo string, number int) *datastore.Key {
+	return datastore.NewKey(ctx, "Record", "", int64(number), repoKey(ctx, repo))
+}
+
+// loadRecord retrieves the tally record of a pull request, or an empty one if
+// nothing was stored yet. Properties of records stored by older versions that
+// were since dropped from the struct are ignored.
+func loadRecord(ctx context.Context, repo string, number int) (*Record, error) {
+	record := new(Record)
+	if err := datastore.Get(ctx, recordKey(ctx, repo, number), record); err != nil && err != datastore.ErrNoSuchEntity {
+		if _, mismatch := err.(*datastore.ErrFieldMismatch); !mismatch {
+			return nil, err
+		}
+	}
+	return record, nil
+}
+
+// updateRecord loads the tally record of a pull request, applies a modification
+// to it and stores it back.
+func updateRecord(ctx context.Context, repo string, number int, update func(record *Record)) error {
+	return datastore.RunInTransaction(ctx, func(ctx context.Context) error {
+		record, err := loadRecord(ctx, repo, number)
+		if err != nil {
+			return err
+		}
+		update(record)
+
+		_, err = datastore.Put(ctx, recordKey(ctx, repo, number), record)
+		return err
+	}, nil)
+}
+
+// saveRecord persists the latest status report of a pull request, along with
+// the comment it was posted in and the head commit it was tallied at.
+func saveRecord(ctx context.Context, repo string, number int, id int, commit string, report string) error {
+	return updateRecord(ctx, repo, number, func(record *Record) {
+		record.CommentID, record.Commit, record.Report, record.Updated = id, commit, report, now()
+	})
+}
+
+// setCommentID persists the identifier of the status report comment of a PR.
+func setCommentID(ctx context.Context, repo string, number int, id int) error {
+	return updateRecord(ctx, repo, number, func(record *Record) {
+		record.CommentID = id
+	})
+}
+
+// setReviewID persists the identifier of the changes requested review of a PR.
+func setReviewID(ctx context.Context, repo string, number int, id int) error {
+	return updateRecord(ctx, repo, number, func(record *Record) {
+		record.ReviewID = id
+	})
+}
+
+// setCheckRun persists the identifier of the last check run of a PR, along with
+// the head commit it was published on.
+func setCheckRun(ctx context.Context, repo string, number int, id int, commit string) error {
+	return updateRecord(ctx, repo, number, func(record *Record) {
+		record.CheckRun, record.CheckCommit = id, commit
+	})
+}
+
+// setDisabled persists whether tallying is opted out of for a pull request.
+func setDisabled(ctx context.Context, repo string, number int, disabled bool) error {
+	return updateRecord(ctx, repo, number, func(record *Record) {
+		record.Disabled = disabled
+	})
+}
+
+// setFinal persists the final state of a closed pull request.
+func setFinal(ctx context.Context, repo string, number int, final string) error {
+	return updateRecord(ctx, repo, number, func(record *Record) {
+		record.Final = final
+	})
+}
+
+// clearFinal drops the final state of a reopened pull request, unfreezing its
+// report too.
+func clearFinal(ctx context.Context, repo string, number int) error {
+	return updateRecord(ctx, repo, number, func(record *Record) {
+		record.Final, record.Frozen = "", false
+	})
+}
+
+// setFrozen persists whether the report of a pull request is frozen.
+func setFrozen(ctx context.Context, repo string, number int, frozen bool) error {
+	return updateRecord(ctx, repo, number, func(record *Record) {
+		record.Frozen = frozen
+	})
+}
+
+// audit persists a timestamped note on an automated action taken on a pull
+// request, adding it to the already loaded record too so reports include it.
+func audit(ctx context.Context, repo string, number int, record *Record, text string) error {
+	text += " on " + now().UTC().Format("Mon Jan 2 15:04:05 MST 2006")
+
+	record.note(text)
+	return updateRecord(ctx, repo, number, func(record *Record) {
+		record.note(text)
+	})
+}
+
+// migrateRecords moves all the tally records of a renamed repository from its
+// old full name to the new one, in batches Datastore can handle. Migrating onto
+// the same name is rejected, as the records would be deleted after being
+// rewritten in place.
+func migrateRecords(ctx context.Context, from, to string) error {
+	if from == to {
+		return &validationError{fmt.Errorf("cannot migrate records of %s onto itself", from)}
+	}
+	var records []Record
+	keys, err := datastore.NewQuery("Record").Ancestor(repoKey(ctx, from)).GetAll(ctx, &records)
+	if err != nil || len(keys) == 0 {
+		return err
+	}
+	for start := 0; start < len(keys); start += maxBatchSize {
+		end := start + maxBatchSize
+		if end > len(keys) {
+			end = len(keys)
+		}
+		moved := make([]*datastore.Key, 0, end-start)
+		for _, key := range keys[start:end] {
+			moved = append(moved, datastore.NewKey(ctx, "Record", "", key.IntID(), repoKey(ctx, to)))
+		}
+		if _, err := datastore.PutMulti(ctx, moved, records[start:end]); err != nil {
+			return err
+		}
+		if err := datastore.DeleteMulti(ctx, keys[start:end]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// staleRecords retrieves the tally records of all repositories that were last
+// updated before the given time, along with their keys.
+func staleRecords(ctx context.Context, before time.Time) ([]*datastore.Key, []Record, error) {
+	var records []Record
+	keys, err := datastore.NewQuery("Record").Filter("Updated <", before).GetAll(ctx, &records)
+	if err != nil {
+		if _, mismatch := err.(*datastore.ErrFieldMismatch); !mismatch {
+			return nil, nil, err
+		}
+	}
+	return keys, records, nil
+}
+
+// savePreference persists whether a user wants to be @mentioned in reports.
+func savePreference(ctx context.Context, user string, muted bool) error {
+	_, err := datastore.Put(ctx, datastore.NewKey(ctx, "Preference", user, 0, nil), &Preference{Muted: muted})
+	return err
+}
+
+// mutedUsers retrieves the set of users who opted out of being @mentioned.
+func mutedUsers(ctx context.Context) (map[string]bool, error) {
+	keys, err := datastore.NewQuery("Preference").Filter("Muted =", true).KeysOnly().GetAll(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	muted := make(map[string]bool)
+	for _, key := range keys {
+		muted[key.StringID()] = true
+	}
+	return muted, nil
+}
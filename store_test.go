@@ -0,0 +1,37 @@
+package robotally
+
+import (
+	"fmt"
+	"testing"
+)
+
+// Tests that renaming a repository moves all its tally records over to the new
+// name, even if there are more than fit into a single Datastore batch.
+func TestMigrateRecords(t *testing.T) {
+	ctx := newContext(t)
+
+	count := maxBatchSize + 20
+	for number := 1; number <= count; number++ {
+		if err := saveRecord(ctx, "owner/old", number, 1000+number, "sha", fmt.Sprintf("report %d", number)); err != nil {
+			t.Fatalf("failed to store record %d: %v", number, err)
+		}
+	}
+	if err := migrateRecords(ctx, "owner/old", "owner/new"); err != nil {
+		t.Fatalf("failed to migrate records: %v", err)
+	}
+	for _, number := range []int{1, maxBatchSize, count} {
+		record, err := loadRecord(ctx, "owner/new", number)
+		if err != nil {
+			t.Fatalf("failed to load migrated record %d: %v", number, err)
+		}
+		if record.CommentID != 1000+number || record.Report != fmt.Sprintf("report %d", number) {
+			t.Errorf("migrated record %d mismatch: %+v", number, record)
+		}
+		if record, err = loadRecord(ctx, "owner/old", number); err != nil || record.CommentID != 0 {
+			t.Errorf("old record %d retained: %+v, %v", number, record, err)
+		}
+	}
+	if err := migrateRecords(ctx, "owner/new", "owner/new"); err == nil {
+		t.Errorf("migration onto the same name accepted")
+	}
+}
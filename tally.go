@@ -0,0 +1,27 @@
+package robotally
+
+// tally is the aggregated review state of a pull request, decoupled from the
+// GitHub API types it was gathered from. Status reports are rendered from it.
+type tally struct {
+	Link     string   // URL of the pull request
+	Warnings []string // Warnings to display at the top of the report, if any
+	Commit   string   // Head commit the tally was made at
+	Final    string   // Final state of the pull request once closed, if any
+
+	Votes     map[string]bool                // Binding votes by user (true = upvote)
+	Advisory  map[string]bool                // Votes of users below the minimum role
+	Stale     map[string]bool                // Votes older than the freshness window
+	Reactions map[string]map[string]struct{} // Additional emoji reactions and their users
+	Linked    map[int]map[string]bool        // Votes of linked pull requests by number
+	Inline    map[string]map[string]struct{} // Users reacting to review comments by vote emoji
+	Forum     map[string]map[string]struct{} // Users reacting to linked discussions by vote emoji
+	Degraded  bool                           // Whether the reactions could not be retrieved
+	Missing   []string                       // Teams whose required approval is missing
+	Reviewers []string                       // Reviewers requested on the pull request (users or org/team names)
+	Teams     map[string][]string            // Members of the teams among the requested reviewers
+	Soft      float64                        // Soft score of the weighted emoji reactions
+
+	Audit []string        // Notes on the automated actions taken on the PR
+	Score float64         // Urgency score of the reactions
+	Muted map[string]bool // Users not to @mention
+}
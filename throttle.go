@@ -0,0 +1,122 @@
+package robotally
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Limits to stay within GitHub's secondary (abuse) rate limits with. GitHub asks
+// integrations not to make concurrent requests with the same token and to wait
+// at least a second between content mutating ones, so calls are serialized per
+// token and writes spaced out. If a limit is tripped nonetheless, all calls are
+// held back until Retry-After elapses and the offending one is retried. As the
+// waits happen while holding the pull request locks, all retries together need
+// to stay well within the lock expiry, longer back-offs failing calls outright
+// for the events to be redelivered later.
+const (
+	mutationInterval = time.Second      // Minimum time between two mutating requests
+	maxRetries       = 2                // Number of times to retry a rate limited request
+	maxRetryWait     = 10 * time.Second // Longest Retry-After to wait out instead of failing
+)
+
+// throttle is the rate limiting state of a single GitHub token.
+type throttle struct {
+	lock  sync.Mutex // Lock serializing all the requests made with the token
+	last  time.Time  // Time of the last mutating request
+	until time.Time  // Time until which all requests are held back
+}
+
+var (
+	throttles     = make(map[string]*throttle) // Rate limiting state by token
+	throttlesLock sync.Mutex                   // Lock protecting the throttle map
+)
+
+// throttleOf retrieves the rate limiting state of a token, creating it if it is
+// not tracked yet.
+func throttleOf(token string) *throttle {
+	throttlesLock.Lock()
+	defer throttlesLock.Unlock()
+
+	if _, ok := throttles[token]; !ok {
+		throttles[token] = new(throttle)
+	}
+	return throttles[token]
+}
+
+// throttledTransport is an HTTP transport queueing the API calls of a token to
+// honor GitHub's secondary rate limits.
+type throttledTransport struct {
+	base     http.RoundTripper
+	throttle *throttle
+}
+
+// RoundTrip implements http.RoundTripper, waiting for the token's turn before
+// executing a request and backing off if GitHub asks to.
+func (t *throttledTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	t.throttle.lock.Lock()
+	defer t.throttle.lock.Unlock()
+
+	mutating := req.Method != "GET" && req.Method != "HEAD"
+	for attempt := 0; ; attempt++ {
+		// Wait until both any back-off and the write spacing elapse
+		wait := t.throttle.until.Sub(time.Now())
+		if wait > maxRetryWait {
+			return nil, fmt.Errorf("rate limited until %v", t.throttle.until.UTC().Format(time.RFC3339))
+		}
+		if mutating {
+			if spacing := t.throttle.last.Add(mutationInterval).Sub(time.Now()); spacing > wait {
+				wait = spacing
+			}
+		}
+		if wait > 0 {
+			timer := time.NewTimer(wait)
+			select {
+			case <-timer.C:
+			case <-req.Context().Done():
+				timer.Stop()
+				return nil, req.Context().Err()
+			}
+		}
+		res, err := t.base.RoundTrip(req)
+		if mutating {
+			t.throttle.last = time.Now()
+		}
+		if err != nil {
+			return nil, err
+		}
+		// If a secondary limit was hit, hold back all calls and retry if sensible
+		delay, limited := retryAfter(res)
+		if !limited {
+			return res, nil
+		}
+		t.throttle.until = time.Now().Add(delay)
+		if attempt >= maxRetries || delay > maxRetryWait || (req.Body != nil && req.GetBody == nil) {
+			return res, nil
+		}
+		res.Body.Close()
+
+		if req.GetBody != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			req.Body = body
+		}
+	}
+}
+
+// retryAfter checks whether a response is a secondary rate limit rejection and
+// if so, how long GitHub asked to wait before retrying.
+func retryAfter(res *http.Response) (time.Duration, bool) {
+	if res.StatusCode != http.StatusForbidden && res.StatusCode != http.StatusTooManyRequests {
+		return 0, false
+	}
+	seconds, err := strconv.Atoi(res.Header.Get("Retry-After"))
+	if err != nil || seconds < 0 {
+		return 0, false
+	}
+	return time.Duration(seconds) * time.Second, true
+}
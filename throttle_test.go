@@ -0,0 +1,98 @@
+package robotally
+
+import (
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// transportFunc is an HTTP transport implemented by a plain function.
+type transportFunc func(req *http.Request) (*http.Response, error)
+
+// RoundTrip implements http.RoundTripper.
+func (f transportFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+// newResponse creates an API response with the given status and Retry-After.
+func newResponse(status int, retry string) *http.Response {
+	res := &http.Response{StatusCode: status, Header: make(http.Header), Body: ioutil.NopCloser(strings.NewReader("{}"))}
+	if retry != "" {
+		res.Header.Set("Retry-After", retry)
+	}
+	return res
+}
+
+// Tests that secondary rate limit rejections are detected along with the time
+// GitHub asked to wait, other failures passing through.
+func TestRetryAfter(t *testing.T) {
+	tests := []struct {
+		status  int
+		retry   string
+		delay   time.Duration
+		limited bool
+	}{
+		{http.StatusOK, "", 0, false},
+		{http.StatusForbidden, "", 0, false},
+		{http.StatusForbidden, "3", 3 * time.Second, true},
+		{http.StatusTooManyRequests, "0", 0, true},
+		{http.StatusNotFound, "3", 0, false},
+		{http.StatusForbidden, "soon", 0, false},
+	}
+	for i, tt := range tests {
+		delay, limited := retryAfter(newResponse(tt.status, tt.retry))
+		if delay != tt.delay || limited != tt.limited {
+			t.Errorf("test %d: back-off mismatch: have %v/%v, want %v/%v", i, delay, limited, tt.delay, tt.limited)
+		}
+	}
+}
+
+// Tests that a rate limited request is retried once Retry-After elapses, but is
+// failed if GitHub asks to wait longer than acceptable.
+func TestThrottleBackOff(t *testing.T) {
+	if maxRetries*maxRetryWait >= lockExpiry {
+		t.Fatalf("throttle back-off outlasts the report locks: %v >= %v", maxRetries*maxRetryWait, lockExpiry)
+	}
+	var calls int
+	transport := &throttledTransport{throttle: new(throttle), base: transportFunc(func(req *http.Request) (*http.Response, error) {
+		if calls++; calls == 1 {
+			return newResponse(http.StatusForbidden, "1"), nil
+		}
+		return newResponse(http.StatusOK, ""), nil
+	})}
+	req, _ := http.NewRequest("GET", "https://api.github.com/repos/owner/repo", nil)
+
+	start := time.Now()
+	res, err := transport.RoundTrip(req)
+	if err != nil {
+		t.Fatalf("failed to execute request: %v", err)
+	}
+	if res.StatusCode != http.StatusOK || calls != 2 {
+		t.Errorf("rate limited request not retried: status %d, %d calls", res.StatusCode, calls)
+	}
+	if elapsed := time.Since(start); elapsed < time.Second {
+		t.Errorf("retried without waiting out the back-off: %v", elapsed)
+	}
+	// Request a back-off beyond the acceptable one, it must not be waited out
+	calls = 0
+	transport = &throttledTransport{throttle: new(throttle), base: transportFunc(func(req *http.Request) (*http.Response, error) {
+		calls++
+		return newResponse(http.StatusForbidden, "3600"), nil
+	})}
+	if res, err = transport.RoundTrip(req); err != nil {
+		t.Fatalf("failed to execute request: %v", err)
+	}
+	if res.StatusCode != http.StatusForbidden || calls != 1 {
+		t.Errorf("excessive back-off waited out: status %d, %d calls", res.StatusCode, calls)
+	}
+	// Later calls must fail fast instead of waiting the back-off out
+	start = time.Now()
+	if _, err = transport.RoundTrip(req); err == nil {
+		t.Errorf("call held back beyond the acceptable back-off succeeded")
+	}
+	if elapsed := time.Since(start); calls != 1 || elapsed > time.Second {
+		t.Errorf("held back call not failed fast: %d calls in %v", calls, elapsed)
+	}
+}
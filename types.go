@@ -3,7 +3,10 @@ package robotally
 // Event is the GitHub webhook notification of a repository action.
 type Event struct {
 	Action      string       `json:"action"`
+	Changes     *Changes     `json:"changes"`
+	Comment     *Comment     `json:"comment"`
 	Issue       *Issue       `json:"issue"`
+	Label       *Label       `json:"label"`
 	PullRequest *PullRequest `json:"pull_request"`
 	Repository  *Repository  `json:"repository"`
 	Sender      *User        `json:"sender"`
@@ -11,27 +14,79 @@ type Event struct {
 
 // Issue represents the data about the issue being reported on.
 type Issue struct {
-	Number int `json:"number"`
+	Number      int        `json:"number"`
+	Labels      []*Label   `json:"labels"`
+	PullRequest *IssueLink `json:"pull_request"`
+}
+
+// IssueLink represents the link of an issue to its pull request, if any.
+type IssueLink struct {
+	URL string `json:"url"`
+}
+
+// Comment represents the data about a comment added to an issue.
+type Comment struct {
+	ID   int    `json:"id"`
+	Body string `json:"body"`
+	User *User  `json:"user"`
 }
 
 // PullRequest represents the data about the PR being reported on.
 type PullRequest struct {
-	Number int       `json:"number"`
-	Base   *Endpoint `json:"base"`
+	Number  int       `json:"number"`
+	HTMLURL string    `json:"html_url"`
+	User    *User     `json:"user"`
+	Labels  []*Label  `json:"labels"`
+	Head    *Endpoint `json:"head"`
+	Base    *Endpoint `json:"base"`
+	Merged  bool      `json:"merged"`
 }
 
 // Repository represents the repository originating a webhook event.
 type Repository struct {
-	Name  string `json:"name"`
-	Owner *User  `json:"owner"`
+	Name     string `json:"name"`
+	FullName string `json:"full_name"`
+	Owner    *User  `json:"owner"`
+}
+
+// Changes represents the modifications reported by an edit or rename event.
+type Changes struct {
+	Repository *RepositoryChanges `json:"repository"`
+}
+
+// RepositoryChanges represents the modified fields of a repository.
+type RepositoryChanges struct {
+	Name *Change `json:"name"`
+}
+
+// Change represents the previous value of a modified field.
+type Change struct {
+	From string `json:"from"`
 }
 
-// Endpoint represents one of the enpoints of a PR comparison.
+// Endpoint represents one of the enpoints of a PR comparison. The repository
+// may differ from the base one for PRs from forks, or be nil if deleted.
 type Endpoint struct {
-	Branch string `json:"ref"`
+	Branch string      `json:"ref"`
+	SHA    string      `json:"sha"`
+	Repo   *Repository `json:"repo"`
+}
+
+// Label represents a label attached to an issue or pull request.
+type Label struct {
+	Name string `json:"name"`
 }
 
 // User represents a GitHub user.
 type User struct {
 	Login string `json:"login"`
 }
+
+// login returns the username of a user, or an empty string if the user is not
+// present in the payload (e.g. a deleted ghost account).
+func (u *User) login() string {
+	if u == nil {
+		return ""
+	}
+	return u.Login
+}
@@ -0,0 +1,46 @@
+package robotally
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+// Tests that the head and base endpoints of a fork pull request are decoded from
+// its webhook payload, surviving a round trip.
+func TestForkPullRequestEndpoints(t *testing.T) {
+	payload := `{
+		"action": "opened",
+		"pull_request": {
+			"number": 1,
+			"head": {"ref": "feature", "sha": "abcdef", "repo": {"name": "fork", "full_name": "forker/fork", "owner": {"login": "forker"}}},
+			"base": {"ref": "master", "sha": "012345", "repo": {"name": "repo", "full_name": "owner/repo", "owner": {"login": "owner"}}}
+		}
+	}`
+	want := &PullRequest{
+		Number: 1,
+		Head:   &Endpoint{Branch: "feature", SHA: "abcdef", Repo: &Repository{Name: "fork", FullName: "forker/fork", Owner: &User{Login: "forker"}}},
+		Base:   &Endpoint{Branch: "master", SHA: "012345", Repo: &Repository{Name: "repo", FullName: "owner/repo", Owner: &User{Login: "owner"}}},
+	}
+	event := new(Event)
+	if err := json.Unmarshal([]byte(payload), event); err != nil {
+		t.Fatalf("failed to decode event: %v", err)
+	}
+	if !reflect.DeepEqual(event.PullRequest, want) {
+		t.Fatalf("pull request mismatch: have %+v, want %+v", event.PullRequest, want)
+	}
+	if event.PullRequest.Head.Repo.FullName == event.PullRequest.Base.Repo.FullName {
+		t.Errorf("fork head not distinguished from base")
+	}
+	blob, err := json.Marshal(event)
+	if err != nil {
+		t.Fatalf("failed to encode event: %v", err)
+	}
+	decoded := new(Event)
+	if err := json.Unmarshal(blob, decoded); err != nil {
+		t.Fatalf("failed to decode round-tripped event: %v", err)
+	}
+	if !reflect.DeepEqual(decoded.PullRequest, want) {
+		t.Errorf("round-tripped pull request mismatch: have %+v, want %+v", decoded.PullRequest, want)
+	}
+}